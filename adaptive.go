@@ -0,0 +1,180 @@
+package pqtimeouts
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults for adaptive read timeouts.
+const (
+	DefaultAdaptivePercentile = 0.99
+	DefaultAdaptiveMultiplier = 3.0
+	DefaultAdaptiveWindow     = time.Minute
+
+	// DefaultAdaptiveMinReadTimeout is the least a learned timeout can be when no minimum is given, so a host that
+	// usually answers in microseconds still has time for a query that is slow but healthy.
+	DefaultAdaptiveMinReadTimeout = 100 * time.Millisecond
+
+	// adaptiveMinSamples is how many reads a host needs before its timeout is learned rather than the maximum.
+	adaptiveMinSamples = 100
+)
+
+// adaptiveConfig describes how adaptive read timeouts are learned.
+type adaptiveConfig struct {
+	percentile float64
+	multiplier float64
+	min        time.Duration
+	max        time.Duration
+	window     time.Duration
+}
+
+// adaptiveTimeouts learns a read timeout for each host a Connector dials. Each one is a multiple of a percentile of
+// the recent time that the first read after a write waited for a response from that host, bounded by a minimum and
+// maximum. Later reads of the same response mostly find data already buffered, so they would only drag it down.
+type adaptiveTimeouts struct {
+	cfg   adaptiveConfig
+	mu    sync.Mutex
+	hosts map[string]*hostLatency
+}
+
+func newAdaptiveTimeouts(cfg adaptiveConfig) *adaptiveTimeouts {
+	if cfg.percentile <= 0 || cfg.percentile >= 1 {
+		cfg.percentile = DefaultAdaptivePercentile
+	}
+	if cfg.multiplier <= 0 {
+		cfg.multiplier = DefaultAdaptiveMultiplier
+	}
+	if cfg.window <= 0 {
+		cfg.window = DefaultAdaptiveWindow
+	}
+	if cfg.min <= 0 {
+		cfg.min = DefaultAdaptiveMinReadTimeout
+		if cfg.max != 0 && cfg.max < cfg.min {
+			cfg.min = cfg.max
+		}
+	}
+	return &adaptiveTimeouts{cfg: cfg, hosts: make(map[string]*hostLatency)}
+}
+
+// host returns the latency tracking for host, creating it if needed.
+func (a *adaptiveTimeouts) host(host string) *hostLatency {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	h := a.hosts[host]
+	if h == nil {
+		h = &hostLatency{cfg: &a.cfg, rotated: time.Now()}
+		a.hosts[host] = h
+	}
+	return h
+}
+
+// timeout returns the current read timeout for host.
+func (a *adaptiveTimeouts) timeout(host string) time.Duration {
+	return a.host(host).timeout()
+}
+
+// hostLatency is the recent read latency of one host. Samples go into the current sketch, which replaces the previous
+// one each window, so the percentile covers between one and two windows of reads.
+type hostLatency struct {
+	cfg      *adaptiveConfig
+	mu       sync.Mutex
+	current  latencySketch
+	previous latencySketch
+	rotated  time.Time
+}
+
+func (h *hostLatency) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.rotated) >= h.cfg.window {
+		h.previous, h.current = h.current, h.previous
+		h.current.reset()
+		h.rotated = now
+	}
+	h.current.add(d)
+}
+
+func (h *hostLatency) timeout() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.current.count+h.previous.count < adaptiveMinSamples {
+		return h.cfg.max
+	}
+	timeout := time.Duration(float64(quantile(h.cfg.percentile, &h.current, &h.previous)) * h.cfg.multiplier)
+	if timeout < h.cfg.min {
+		return h.cfg.min
+	}
+	if h.cfg.max != 0 && timeout > h.cfg.max {
+		return h.cfg.max
+	}
+	return timeout
+}
+
+// Latency sketch buckets grow by sketchGrowth from sketchBase, which keeps the relative error of a percentile under
+// 5% from 10µs to beyond an hour.
+const (
+	sketchBase    = 10 * time.Microsecond
+	sketchGrowth  = 1.05
+	sketchBuckets = 410
+)
+
+var sketchLogGrowth = math.Log(sketchGrowth)
+
+// latencySketch is a histogram of durations with logarithmically sized buckets, in the manner of an HDR histogram.
+type latencySketch struct {
+	counts [sketchBuckets]uint32
+	count  uint64
+}
+
+func (s *latencySketch) add(d time.Duration) {
+	s.counts[sketchBucket(d)]++
+	s.count++
+}
+
+func (s *latencySketch) reset() {
+	*s = latencySketch{}
+}
+
+func sketchBucket(d time.Duration) int {
+	if d <= sketchBase {
+		return 0
+	}
+	i := int(math.Log(float64(d)/float64(sketchBase))/sketchLogGrowth) + 1
+	if i >= sketchBuckets {
+		return sketchBuckets - 1
+	}
+	return i
+}
+
+// sketchUpperBound returns the longest duration counted in bucket i.
+func sketchUpperBound(i int) time.Duration {
+	return time.Duration(float64(sketchBase) * math.Pow(sketchGrowth, float64(i)))
+}
+
+// quantile returns the duration below which the fraction q of the samples in sketches fall.
+func quantile(q float64, sketches ...*latencySketch) time.Duration {
+	var total uint64
+	for _, s := range sketches {
+		total += s.count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i := 0; i < sketchBuckets; i++ {
+		for _, s := range sketches {
+			seen += uint64(s.counts[i])
+		}
+		if seen >= rank {
+			return sketchUpperBound(i)
+		}
+	}
+	return sketchUpperBound(sketchBuckets - 1)
+}
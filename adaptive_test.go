@@ -0,0 +1,187 @@
+package pqtimeouts
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	var sketch latencySketch
+	for i := 1; i <= 1000; i++ {
+		sketch.add(time.Duration(i) * time.Millisecond)
+	}
+
+	p50 := quantile(0.5, &sketch)
+	if p50 < 500*time.Millisecond || p50 > 525*time.Millisecond {
+		t.Errorf("p50 was not as expected: %v", p50)
+	}
+
+	p99 := quantile(0.99, &sketch)
+	if p99 < 990*time.Millisecond || p99 > 1040*time.Millisecond {
+		t.Errorf("p99 was not as expected: %v", p99)
+	}
+
+	if quantile(0.99, &latencySketch{}) != 0 {
+		t.Error("The quantile of an empty sketch should be 0")
+	}
+}
+
+func TestSketchBucketBounds(t *testing.T) {
+	if sketchBucket(0) != 0 || sketchBucket(time.Microsecond) != 0 {
+		t.Error("Durations under the base should use the first bucket")
+	}
+
+	if sketchBucket(24*time.Hour) != sketchBuckets-1 {
+		t.Error("Very long durations should use the last bucket")
+	}
+
+	for _, d := range []time.Duration{11 * time.Microsecond, time.Millisecond, 3 * time.Second} {
+		i := sketchBucket(d)
+		if d > sketchUpperBound(i) || d <= sketchUpperBound(i-1) {
+			t.Errorf("%v was put in the wrong bucket: %d", d, i)
+		}
+	}
+}
+
+func TestAdaptiveTimeoutBounds(t *testing.T) {
+	adaptive := newAdaptiveTimeouts(adaptiveConfig{min: 50 * time.Millisecond, max: 5 * time.Second})
+	host := adaptive.host("db1")
+
+	if host.timeout() != 5*time.Second {
+		t.Errorf("The maximum should be used until there are enough samples: %v", host.timeout())
+	}
+
+	for i := 0; i < adaptiveMinSamples; i++ {
+		host.observe(time.Millisecond)
+	}
+	if host.timeout() != 50*time.Millisecond {
+		t.Errorf("The timeout should not go below the minimum: %v", host.timeout())
+	}
+
+	for i := 0; i < 10*adaptiveMinSamples; i++ {
+		host.observe(100 * time.Millisecond)
+	}
+	timeout := host.timeout()
+	if timeout < 300*time.Millisecond || timeout > 315*time.Millisecond {
+		t.Errorf("The timeout should be three times the p99: %v", timeout)
+	}
+
+	for i := 0; i < 10*adaptiveMinSamples; i++ {
+		host.observe(10 * time.Second)
+	}
+	if host.timeout() != 5*time.Second {
+		t.Errorf("The timeout should not go above the maximum: %v", host.timeout())
+	}
+
+	if adaptive.timeout("db2") != 5*time.Second {
+		t.Error("Hosts should be learned separately")
+	}
+}
+
+func TestAdaptiveWindowRotates(t *testing.T) {
+	adaptive := newAdaptiveTimeouts(adaptiveConfig{max: time.Minute, window: time.Millisecond})
+	host := adaptive.host("db1")
+
+	for i := 0; i < adaptiveMinSamples; i++ {
+		host.observe(time.Second)
+	}
+	time.Sleep(2 * time.Millisecond)
+	host.observe(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	host.observe(time.Millisecond)
+
+	if host.current.count+host.previous.count != 2 {
+		t.Errorf("Old samples should have been dropped: %d", host.current.count+host.previous.count)
+	}
+}
+
+func TestAdaptiveReadDeadline(t *testing.T) {
+	testConn := &testDataConn{reads: [][]byte{{'x'}}}
+
+	connector := NewConnector(Config{
+		ReadTimeout:            2 * time.Second,
+		AdaptiveReadTimeout:    true,
+		AdaptiveMinReadTimeout: time.Second})
+	dialer := connector.dialer()
+	dialer.netDial = func(network string, address string) (net.Conn, error) {
+		return testConn, nil
+	}
+
+	conn, _ := dialer.Dial("tcp", "db1:5432")
+	conn.Write([]byte{'x'})
+	before := time.Now()
+	conn.Read(make([]byte, 1))
+
+	// The deadline may be set up to 1/deadlineSlack later than needed, so later reads can share it.
+	deadline := testConn.setReadDeadlineTime
+	latest := time.Now().Add(2*time.Second + 2*time.Second/deadlineSlack)
+	if deadline.Before(before.Add(2*time.Second)) || deadline.After(latest) {
+		t.Errorf("The read deadline should use the maximum: %v", deadline)
+	}
+
+	if connector.AdaptiveReadTimeout("db1") != 2*time.Second {
+		t.Errorf("The learned timeout was not as expected: %v", connector.AdaptiveReadTimeout("db1"))
+	}
+
+	host := connector.adaptive.host("db1")
+	if host.current.count != 1 {
+		t.Error("The read should have been observed")
+	}
+
+	if NewConnector(Config{}).AdaptiveReadTimeout("db1") != 0 {
+		t.Error("The learned timeout should be 0 when adaptive timeouts are off")
+	}
+}
+
+func TestAdaptiveLearnsResponseWaits(t *testing.T) {
+	testConn := &testDataConn{}
+	connector := NewConnector(Config{ReadTimeout: 5 * time.Second, AdaptiveReadTimeout: true})
+	dialer := connector.dialer()
+	dialer.netDial = func(network string, address string) (net.Conn, error) {
+		return testConn, nil
+	}
+	conn, _ := dialer.Dial("tcp", "db1:5432")
+
+	// A burst of fast reads of buffered rows after each query.
+	for i := 0; i < 2*adaptiveMinSamples; i++ {
+		conn.Write([]byte{'Q'})
+		for j := 0; j < 10; j++ {
+			testConn.reads = append(testConn.reads, []byte{'D'})
+			conn.Read(make([]byte, 1))
+		}
+	}
+	if count := connector.adaptive.host("db1").current.count; count != 2*adaptiveMinSamples {
+		t.Errorf("Only the first read after each write should have been observed, %d were", count)
+	}
+	if timeout := connector.AdaptiveReadTimeout("db1"); timeout != DefaultAdaptiveMinReadTimeout {
+		t.Errorf("The learned timeout should not go below the default minimum: %v", timeout)
+	}
+
+	// The next, slower query still has the minimum to answer in.
+	conn.Write([]byte{'Q'})
+	testConn.reads = append(testConn.reads, []byte{'D'})
+	before := time.Now()
+	conn.Read(make([]byte, 1))
+	if deadline := testConn.setReadDeadlineTime; deadline.Before(before.Add(DefaultAdaptiveMinReadTimeout)) {
+		t.Errorf("The read deadline should be at least the default minimum away: %v", deadline.Sub(before))
+	}
+}
+
+func TestParseConfigAdaptive(t *testing.T) {
+	cfg, err := ParseConfig("dbname=pqtest adaptive_read_timeout=true adaptive_percentile=0.95 adaptive_multiplier=4 " +
+		"adaptive_min_read_timeout=20 adaptive_max_read_timeout=3000")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if !cfg.AdaptiveReadTimeout || cfg.AdaptivePercentile != 0.95 || cfg.AdaptiveMultiplier != 4 ||
+		cfg.AdaptiveMinReadTimeout != 20*time.Millisecond || cfg.AdaptiveMaxReadTimeout != 3*time.Second {
+		t.Errorf("Adaptive settings were not as expected: %+v", cfg)
+	}
+
+	if _, err := ParseConfig("adaptive_multiplier=lots"); err == nil || err.Error() != "Error interpreting value for adaptive_multiplier" {
+		t.Errorf("The error is unexpected: %v", err)
+	}
+}
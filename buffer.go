@@ -0,0 +1,112 @@
+package pqtimeouts
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// DefaultBufferSize is the size of the read and write buffers of a buffered connection.
+const DefaultBufferSize = 16 * 1024
+
+// readBuffer fills a reusable buffer with one read of the connection and hands it out in pieces, so many small reads
+// by lib/pq cost one read, and one deadline, of the connection.
+type readBuffer struct {
+	buf  []byte
+	r, w int
+	err  error // Returned once the buffer is drained
+}
+
+// read copies buffered bytes into b, filling the buffer with fill when it is empty. Reads at least as large as the
+// buffer go straight to fill.
+func (rb *readBuffer) read(b []byte, fill func([]byte) (int, error)) (int, error) {
+	if rb.r == rb.w {
+		if rb.err != nil {
+			err := rb.err
+			rb.err = nil
+			return 0, err
+		}
+		if len(b) >= len(rb.buf) {
+			return fill(b)
+		}
+		n, err := fill(rb.buf)
+		rb.r, rb.w = 0, n
+		if n == 0 {
+			return 0, err
+		}
+		rb.err = err
+	}
+	n := copy(b, rb.buf[rb.r:rb.w])
+	rb.r += n
+	return n, nil
+}
+
+// writeBuffer holds messages the server doesn't answer until a later Sync or Flush, so a batch of them can be sent
+// with one write of the connection. Reads flush it, and lib/pq reads while it writes during COPY, so it is locked.
+type writeBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+// write buffers b if it only holds messages that can wait, and otherwise sends everything buffered along with b using
+// flush. It returns len(b) if b was buffered.
+func (wb *writeBuffer) write(b []byte, flush func([]byte) (int, error)) (int, error) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if deferrable(b) {
+		wb.buf = append(wb.buf, b...)
+		if len(wb.buf) < wb.size {
+			return len(b), nil
+		}
+		return len(b), wb.flush(flush)
+	}
+	if len(wb.buf) == 0 {
+		return flush(b)
+	}
+	wb.buf = append(wb.buf, b...)
+	if err := wb.flush(flush); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flushPending sends anything buffered.
+func (wb *writeBuffer) flushPending(flush func([]byte) (int, error)) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if len(wb.buf) == 0 {
+		return nil
+	}
+	return wb.flush(flush)
+}
+
+// flush sends everything buffered. The caller holds wb.mu.
+func (wb *writeBuffer) flush(flush func([]byte) (int, error)) error {
+	_, err := flush(wb.buf)
+	wb.buf = wb.buf[:0]
+	return err
+}
+
+// deferrable reports whether b is a sequence of whole messages the server doesn't answer until a Sync or Flush: Parse,
+// Bind, Describe, Execute and Close.
+func deferrable(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return false
+		}
+		switch b[0] {
+		case 'P', 'B', 'D', 'E', 'C':
+		default:
+			return false
+		}
+		length := int(binary.BigEndian.Uint32(b[1:5]))
+		if length < 4 || length+1 > len(b) {
+			return false
+		}
+		b = b[length+1:]
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package pqtimeouts
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+// testRecordConn records each write to it and serves reads from data.
+type testRecordConn struct {
+	testNetConn
+	writes [][]byte
+	data   []byte
+	reads  int
+}
+
+func (c *testRecordConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (c *testRecordConn) Read(b []byte) (int, error) {
+	c.reads++
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestBufferedWrites(t *testing.T) {
+	testConn := &testRecordConn{}
+	conn := &timeoutConn{conn: testConn, writeTimeout: time.Second,
+		writeBuffer: &writeBuffer{size: DefaultBufferSize}}
+
+	h := &hintTracker{}
+	parse := h.build('P', []byte("\x00SELECT $1\x00"), []byte{0, 0})
+	bind := h.build('B', []byte("\x00\x00"), []byte{0, 0, 0, 0, 0, 0})
+	execute := h.build('E', []byte("\x00"), []byte{0, 0, 0, 0})
+	sync := h.build('S')
+	for _, message := range [][]byte{parse, bind, execute, sync} {
+		if n, err := conn.Write(message); n != len(message) || err != nil {
+			t.Fatalf("Unexpected write result: %d, %v", n, err)
+		}
+	}
+
+	if len(testConn.writes) != 1 {
+		t.Fatalf("Expected the messages to be coalesced into one write, got %d", len(testConn.writes))
+	}
+	if expected := bytes.Join([][]byte{parse, bind, execute, sync}, nil); !bytes.Equal(testConn.writes[0], expected) {
+		t.Errorf("The write was not as expected: %q", testConn.writes[0])
+	}
+	if testConn.setWriteDeadlineCalled != 1 {
+		t.Errorf("Expected one deadline for the batch, got %d", testConn.setWriteDeadlineCalled)
+	}
+
+	// A read sends anything still buffered first.
+	conn.Write(parse)
+	conn.Read(make([]byte, 1))
+	if len(testConn.writes) != 2 || !bytes.Equal(testConn.writes[1], parse) {
+		t.Errorf("Expected the buffered message to be sent before reading, got %q", testConn.writes)
+	}
+}
+
+func TestDeferrable(t *testing.T) {
+	h := &hintTracker{}
+	for _, test := range []struct {
+		b        []byte
+		expected bool
+	}{
+		{h.build('P', []byte("\x00SELECT 1\x00\x00\x00")), true},
+		{append(h.build('B', []byte("\x00\x00")), h.build('E', []byte("\x00\x00\x00\x00\x00"))...), true},
+		{h.build('d', []byte("1\t2\n")), false},
+		{h.build('S'), false},
+		{h.build('Q', []byte("SELECT 1\x00")), false},
+		{append(h.build('P', []byte("\x00SELECT 1\x00\x00\x00")), 'S'), false},
+		{[]byte{0, 0, 0, 8, 4, 210, 22, 47}, false},
+		{nil, false},
+	} {
+		if deferrable(test.b) != test.expected {
+			t.Errorf("deferrable(%q) should be %v", test.b, test.expected)
+		}
+	}
+}
+
+func TestBufferedReads(t *testing.T) {
+	testConn := &testRecordConn{data: []byte("abcdefghij")}
+	conn := &timeoutConn{conn: testConn, readTimeout: time.Second, readBuffer: &readBuffer{buf: make([]byte, 8)}}
+
+	var got []byte
+	b := make([]byte, 3)
+	for {
+		n, err := conn.Read(b)
+		got = append(got, b[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	if string(got) != "abcdefghij" {
+		t.Errorf("The data read was not as expected: %q", got)
+	}
+	if testConn.reads != 3 {
+		t.Errorf("Expected the connection to be read in buffer sized pieces, got %d reads", testConn.reads)
+	}
+
+	// Reads as large as the buffer skip it.
+	testConn.data, testConn.reads = []byte("0123456789"), 0
+	if n, _ := conn.Read(make([]byte, 16)); n != 10 || testConn.reads != 1 {
+		t.Errorf("Expected a direct read, got %d bytes in %d reads", n, testConn.reads)
+	}
+}
+
+func TestBufferedQueries(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT name FROM users WHERE id = $1", pqtimeoutstest.Response{
+		Columns: []string{"name"}, Rows: [][]string{{"alice"}}})
+
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=1000 write_timeout=1000 buffered=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		var name string
+		if err := db.QueryRow("SELECT name FROM users WHERE id = $1", 1).Scan(&name); err != nil || name != "alice" {
+			t.Errorf("Unexpected query result: %q, %v", name, err)
+		}
+	}
+}
+
+// TestBufferedCopyIn runs COPY FROM STDIN in buffered mode.
+func TestBufferedCopyIn(t *testing.T) {
+	testCopyIn(t, "read_timeout=1000 write_timeout=1000 buffered=true", nil)
+}
@@ -0,0 +1,131 @@
+package pqtimeouts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificates are the client certificates and root certificate authorities used for a new connection.
+type Certificates struct {
+	Client  []tls.Certificate // Presented to the server when it asks for a client certificate
+	RootCAs *x509.CertPool    // Used to verify the server's certificate, or nil for the system roots
+}
+
+// CertificateProvider supplies certificates when pq-timeouts negotiates TLS. It is consulted on each new dial, so
+// rotated certificates are picked up by new connections without restarting. It must be safe for concurrent use.
+type CertificateProvider interface {
+	Certificates(ctx context.Context) (Certificates, error)
+}
+
+// MemoryCertificates is a CertificateProvider holding certificates in memory, for example from a secrets store. Set
+// replaces them for new connections.
+type MemoryCertificates struct {
+	mu    sync.RWMutex
+	certs Certificates
+}
+
+// NewMemoryCertificates returns a MemoryCertificates holding certs.
+func NewMemoryCertificates(certs Certificates) *MemoryCertificates {
+	return &MemoryCertificates{certs: certs}
+}
+
+// Set replaces the certificates used by new connections.
+func (m *MemoryCertificates) Set(certs Certificates) {
+	m.mu.Lock()
+	m.certs = certs
+	m.mu.Unlock()
+}
+
+func (m *MemoryCertificates) Certificates(context.Context) (Certificates, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.certs, nil
+}
+
+// FileCertificates is a CertificateProvider reading PEM files, as sslcert, sslkey and sslrootcert do. The files are
+// checked on each dial and read again when any of them has changed. If they can't be read, for example while they are
+// only partly replaced, the certificates read last are kept and reading is tried again on the next dial.
+type FileCertificates struct {
+	certFile, keyFile, rootCertFile string
+
+	mu     sync.Mutex
+	stamps [3]fileStamp
+	certs  Certificates
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewFileCertificates returns a FileCertificates for the given files, any of which may be empty. The client
+// certificate and key must be given together. The files are read immediately, so missing or invalid files are
+// reported here.
+func NewFileCertificates(certFile, keyFile, rootCertFile string) (*FileCertificates, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("pqtimeouts: a client certificate and key must be given together")
+	}
+	f := &FileCertificates{certFile: certFile, keyFile: keyFile, rootCertFile: rootCertFile}
+	stamps, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(stamps); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileCertificates) Certificates(context.Context) (Certificates, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stamps, err := f.stat(); err == nil && stamps != f.stamps {
+		f.load(stamps)
+	}
+	return f.certs, nil
+}
+
+// stat returns the current version of each file.
+func (f *FileCertificates) stat() (stamps [3]fileStamp, err error) {
+	for i, path := range []string{f.certFile, f.keyFile, f.rootCertFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return stamps, fmt.Errorf("pqtimeouts: %w", err)
+		}
+		stamps[i] = fileStamp{info.ModTime(), info.Size()}
+	}
+	return stamps, nil
+}
+
+// load reads the files, keeping the previous certificates if any of them can't be read.
+func (f *FileCertificates) load(stamps [3]fileStamp) error {
+	var certs Certificates
+	if f.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return fmt.Errorf("pqtimeouts: loading client certificate: %w", err)
+		}
+		certs.Client = []tls.Certificate{cert}
+	}
+	if f.rootCertFile != "" {
+		pem, err := os.ReadFile(f.rootCertFile)
+		if err != nil {
+			return fmt.Errorf("pqtimeouts: loading root certificate: %w", err)
+		}
+		certs.RootCAs = x509.NewCertPool()
+		if !certs.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("pqtimeouts: no certificates found in %s", f.rootCertFile)
+		}
+	}
+	f.certs, f.stamps = certs, stamps
+	return nil
+}
@@ -0,0 +1,101 @@
+package pqtimeouts
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+// writeCertificate writes cert and its key as PEM files in dir.
+func writeCertificate(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestFileCertificates(t *testing.T) {
+	dir := t.TempDir()
+	first, _ := pqtimeoutstest.Certificate("first")
+	certFile, keyFile := writeCertificate(t, dir, first)
+	files, err := NewFileCertificates(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := func() string {
+		certs, err := files.Certificates(context.Background())
+		if err != nil || len(certs.Client) != 1 {
+			t.Fatalf("Expected a client certificate, got %v, %v", certs, err)
+		}
+		cert, _ := x509.ParseCertificate(certs.Client[0].Certificate[0])
+		return cert.DNSNames[0]
+	}
+	if s := subject(); s != "first" {
+		t.Errorf("Expected the first certificate, got %s", s)
+	}
+
+	// A partly written replacement keeps the last certificate.
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if s := subject(); s != "first" {
+		t.Errorf("Expected the first certificate to be kept, got %s", s)
+	}
+
+	second, _ := pqtimeoutstest.Certificate("second")
+	writeCertificate(t, dir, second)
+	os.Chtimes(certFile, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	os.Chtimes(keyFile, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if s := subject(); s != "second" {
+		t.Errorf("Expected the rotated certificate, got %s", s)
+	}
+
+	if _, err := NewFileCertificates(certFile, "", ""); err == nil {
+		t.Error("Expected an error for a certificate without a key")
+	}
+	if _, err := NewFileCertificates("", "", filepath.Join(dir, "missing.crt")); err == nil {
+		t.Error("Expected an error for a missing root certificate")
+	}
+}
+
+func TestCertificateProviderRotation(t *testing.T) {
+	cert, pool := pqtimeoutstest.Certificate("127.0.0.1")
+	_, otherPool := pqtimeoutstest.Certificate("127.0.0.1")
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.SetStartup(pqtimeoutstest.Startup{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+
+	cfg, err := ParseConfig(srv.ConnString() + " read_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnString = withSetting(cfg.ConnString, "sslmode", "verify-full")
+	provider := NewMemoryCertificates(Certificates{RootCAs: otherPool})
+	cfg.CertificateProvider = provider
+	db := sql.OpenDB(NewConnector(cfg))
+	defer db.Close()
+
+	if err := db.Ping(); err == nil {
+		t.Error("Expected the server's certificate to be refused")
+	}
+	provider.Set(Certificates{RootCAs: pool})
+	if err := db.Ping(); err != nil {
+		t.Errorf("Expected the rotated root certificate to be used, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package pqtimeouts
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault is a failure Chaos can inject into a read or write.
+type Fault int
+
+const (
+	FaultNone         Fault = iota
+	FaultStall              // Block until the deadline passes or the connection is closed
+	FaultPartialWrite       // Write half of the data and fail with io.ErrShortWrite
+	FaultReset              // Close the connection and fail as if the server reset it
+	FaultCorrupt            // Flip the bits of one byte of the data
+)
+
+var faultNames = []string{"none", "stall", "partial write", "reset", "corrupt"}
+
+func (f Fault) String() string {
+	if f < 0 || int(f) >= len(faultNames) {
+		return "invalid"
+	}
+	return faultNames[f]
+}
+
+// ChaosStep is a scripted fault. It lets Skip operations through before injecting Fault after a delay of Delay.
+type ChaosStep struct {
+	Skip  int
+	Fault Fault
+	Delay time.Duration
+}
+
+// ChaosConfig describes the faults a Chaos injects. Scripted steps are used first, in order; once a direction's
+// schedule is used up each operation gets a fault at random with the given probabilities. Faults that don't apply to
+// a direction, such as a partial read, are ignored.
+type ChaosConfig struct {
+	Latency time.Duration // Added to every read and write
+	Jitter  time.Duration // Random extra latency up to this is added to every read and write
+
+	StallProbability        float64
+	PartialWriteProbability float64
+	ResetProbability        float64
+	CorruptProbability      float64
+
+	ReadSchedule  []ChaosStep
+	WriteSchedule []ChaosStep
+
+	Seed int64 // Seeds the random choices, so a run can be repeated
+}
+
+// chaosSchedule is the remaining steps of one direction.
+type chaosSchedule struct {
+	steps   []ChaosStep
+	skipped int
+}
+
+func (s *chaosSchedule) next() (ChaosStep, bool) {
+	if len(s.steps) == 0 {
+		return ChaosStep{}, false
+	}
+	if s.skipped < s.steps[0].Skip {
+		s.skipped++
+		return ChaosStep{}, true
+	}
+	step := s.steps[0]
+	s.steps = s.steps[1:]
+	s.skipped = 0
+	return step, true
+}
+
+// Chaos injects latency, stalls, partial writes, connection resets and corrupted bytes into the connections it wraps,
+// for testing how an application handles network failures. Set Config.Chaos to use it for the connections of a
+// Connector. Faults are injected beneath the timeoutConn, so they are subject to its timeouts. A Chaos is safe for
+// concurrent use, and its schedules are shared by all the connections it wraps.
+type Chaos struct {
+	mu       sync.Mutex
+	cfg      ChaosConfig
+	rand     *rand.Rand
+	reads    chaosSchedule
+	writes   chaosSchedule
+	injected map[Fault]int
+}
+
+// NewChaos returns a Chaos injecting the faults described by cfg.
+func NewChaos(cfg ChaosConfig) *Chaos {
+	c := &Chaos{}
+	c.Set(cfg)
+	return c
+}
+
+// Set replaces the faults being injected, restarting the schedules and random choices. Connections already wrapped
+// are affected from their next operation.
+func (c *Chaos) Set(cfg ChaosConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg = cfg
+	c.rand = rand.New(rand.NewSource(cfg.Seed))
+	c.reads = chaosSchedule{steps: append([]ChaosStep(nil), cfg.ReadSchedule...)}
+	c.writes = chaosSchedule{steps: append([]ChaosStep(nil), cfg.WriteSchedule...)}
+	c.injected = make(map[Fault]int)
+}
+
+// Injected returns how many times fault has been injected since the Chaos was created or last Set.
+func (c *Chaos) Injected(fault Fault) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.injected[fault]
+}
+
+// Conn wraps conn so faults are injected into it.
+func (c *Chaos) Conn(conn net.Conn) net.Conn {
+	return &chaosConn{Conn: conn, chaos: c, closed: make(chan struct{})}
+}
+
+// next chooses the fault and delay for the next operation in one direction.
+func (c *Chaos) next(write bool) (Fault, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	schedule := &c.reads
+	if write {
+		schedule = &c.writes
+	}
+	delay := c.cfg.Latency
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.cfg.Jitter)))
+	}
+
+	step, scripted := schedule.next()
+	if !scripted {
+		step.Fault = c.randomFault()
+	}
+	if step.Fault == FaultPartialWrite && !write {
+		step.Fault = FaultNone
+	}
+	if step.Fault != FaultNone {
+		c.injected[step.Fault]++
+	}
+	return step.Fault, delay + step.Delay
+}
+
+func (c *Chaos) randomFault() Fault {
+	r := c.rand.Float64()
+	for _, f := range []struct {
+		fault       Fault
+		probability float64
+	}{
+		{FaultStall, c.cfg.StallProbability},
+		{FaultPartialWrite, c.cfg.PartialWriteProbability},
+		{FaultReset, c.cfg.ResetProbability},
+		{FaultCorrupt, c.cfg.CorruptProbability},
+	} {
+		if r < f.probability {
+			return f.fault
+		}
+		r -= f.probability
+	}
+	return FaultNone
+}
+
+func (c *Chaos) intn(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Intn(n)
+}
+
+// chaosConn is a connection wrapped by a Chaos. It keeps track of its deadlines so delays and stalls end with a
+// timeout when the deadline passes, as a real network stall would.
+type chaosConn struct {
+	net.Conn
+	chaos *Chaos
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineSet   chan struct{} // Closed and replaced when a deadline changes
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	fault, delay := c.chaos.next(false)
+	if err := c.wait(delay, false, fault == FaultStall); err != nil {
+		return 0, err
+	}
+
+	switch fault {
+	case FaultReset:
+		return 0, c.reset("read")
+	case FaultCorrupt:
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			b[c.chaos.intn(n)] ^= 0xff
+		}
+		return n, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	fault, delay := c.chaos.next(true)
+	if err := c.wait(delay, true, fault == FaultStall); err != nil {
+		return 0, err
+	}
+
+	switch fault {
+	case FaultReset:
+		return 0, c.reset("write")
+	case FaultPartialWrite:
+		n, err := c.Conn.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	case FaultCorrupt:
+		if len(b) > 0 {
+			corrupted := append([]byte(nil), b...)
+			corrupted[c.chaos.intn(len(b))] ^= 0xff
+			return c.Conn.Write(corrupted)
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// wait sleeps for delay, or until the connection is closed when stall is set. It fails if the read or write deadline
+// passes first, following any changes made to the deadline while waiting.
+func (c *chaosConn) wait(delay time.Duration, write bool, stall bool) error {
+	if delay <= 0 && !stall {
+		return nil
+	}
+	var done <-chan time.Time
+	if !stall {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		done = timer.C
+	}
+
+	for {
+		deadline, changed := c.deadline(write)
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			until := time.Until(deadline)
+			if until <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(until)
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-done:
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-c.closed:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return err
+	}
+}
+
+// deadline returns the read or write deadline, and a channel closed when a deadline next changes.
+func (c *chaosConn) deadline(write bool) (time.Time, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deadlineSet == nil {
+		c.deadlineSet = make(chan struct{})
+	}
+	if write {
+		return c.writeDeadline, c.deadlineSet
+	}
+	return c.readDeadline, c.deadlineSet
+}
+
+func (c *chaosConn) setDeadline(read, write bool, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read {
+		c.readDeadline = t
+	}
+	if write {
+		c.writeDeadline = t
+	}
+	if c.deadlineSet != nil {
+		close(c.deadlineSet)
+		c.deadlineSet = nil
+	}
+}
+
+// reset closes the connection and returns the error a read or write gets when the server resets it.
+func (c *chaosConn) reset(op string) error {
+	c.Close()
+	return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, syscall.ECONNRESET)}
+}
+
+func (c *chaosConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *chaosConn) SetDeadline(t time.Time) error {
+	c.setDeadline(true, true, t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *chaosConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(true, false, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *chaosConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(false, true, t)
+	return c.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,124 @@
+package pqtimeouts
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// chaosPipe returns a client connection wrapped by chaos and the server end of it.
+func chaosPipe(chaos *Chaos) (net.Conn, net.Conn) {
+	client, server := net.Pipe()
+	return chaos.Conn(client), server
+}
+
+func TestChaosStall(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{ReadSchedule: []ChaosStep{{Fault: FaultStall}}}))
+	defer server.Close()
+
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("Expected a stalled read to time out, got %v", err)
+	}
+}
+
+func TestChaosStallThroughTimeoutConn(t *testing.T) {
+	chaos := NewChaos(ChaosConfig{ReadSchedule: []ChaosStep{{Skip: 1, Fault: FaultStall}}})
+	client, server := chaosPipe(chaos)
+	defer server.Close()
+	go server.Write([]byte("a"))
+
+	conn := &timeoutConn{conn: client, readTimeout: 20 * time.Millisecond}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("The first read should be let through, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("Expected the read timeout to fire, got %v", err)
+	}
+	if chaos.Injected(FaultStall) != 1 {
+		t.Errorf("Expected 1 stall, got %d", chaos.Injected(FaultStall))
+	}
+}
+
+func TestChaosReset(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{WriteSchedule: []ChaosStep{{Fault: FaultReset}}}))
+	defer server.Close()
+
+	if _, err := client.Write([]byte("Q")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected a connection reset, got %v", err)
+	}
+	if _, err := client.Write([]byte("Q")); err == nil {
+		t.Error("The connection should be closed after a reset")
+	}
+}
+
+func TestChaosPartialWrite(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{WriteSchedule: []ChaosStep{{Fault: FaultPartialWrite}}}))
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	if n, err := client.Write([]byte("abcd")); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("Expected 2 bytes and a short write, got %d, %v", n, err)
+	}
+}
+
+func TestChaosCorrupt(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{ReadSchedule: []ChaosStep{{Fault: FaultCorrupt}}}))
+	defer server.Close()
+	go server.Write([]byte("abcd"))
+
+	b := make([]byte, 4)
+	n, _ := client.Read(b)
+	if n != 4 || string(b) == "abcd" {
+		t.Errorf("Expected a corrupted read, got %q", b[:n])
+	}
+}
+
+func TestChaosLatency(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{Latency: 30 * time.Millisecond}))
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	start := time.Now()
+	client.Write([]byte("a"))
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected the write to be delayed, took %v", elapsed)
+	}
+
+	client.SetWriteDeadline(time.Now().Add(5 * time.Millisecond))
+	if _, err := client.Write([]byte("a")); !isTimeout(err) {
+		t.Errorf("Expected the delay to hit the deadline, got %v", err)
+	}
+}
+
+func TestChaosSeedRepeats(t *testing.T) {
+	cfg := ChaosConfig{StallProbability: 0.2, ResetProbability: 0.2, CorruptProbability: 0.2, Seed: 42}
+	a, b := NewChaos(cfg), NewChaos(cfg)
+
+	for i := 0; i < 100; i++ {
+		fa, _ := a.next(i%2 == 0)
+		fb, _ := b.next(i%2 == 0)
+		if fa != fb {
+			t.Fatalf("Faults differed at operation %d: %v and %v", i, fa, fb)
+		}
+	}
+	if a.Injected(FaultStall) == 0 || a.Injected(FaultReset) == 0 || a.Injected(FaultCorrupt) == 0 {
+		t.Error("Expected every fault to be injected at least once")
+	}
+}
+
+func TestChaosStallFollowsDeadline(t *testing.T) {
+	client, server := chaosPipe(NewChaos(ChaosConfig{ReadSchedule: []ChaosStep{{Fault: FaultStall}}}))
+	defer server.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.SetReadDeadline(time.Now())
+	}()
+	if _, err := client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("Expected a deadline set during a stall to end it, got %v", err)
+	}
+}
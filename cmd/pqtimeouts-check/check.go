@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+)
+
+// redacted replaces secrets in the report and in errors.
+const redacted = "********"
+
+// secret reports whether the setting key holds a secret. With sslinline=true, sslkey and sslcert hold the key and
+// certificate themselves rather than paths to them.
+func secret(key string, inline bool) bool {
+	switch key {
+	case "password", "sslpassword":
+		return true
+	case "sslkey", "sslcert":
+		return inline
+	}
+	return false
+}
+
+var (
+	userinfoPattern = regexp.MustCompile(`://[^@\s]*@`)
+	secretPattern   = regexp.MustCompile(`\b(password|sslpassword|sslkey|sslcert)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]*)`)
+)
+
+// redact removes the user information of URLs and the values of secret settings from text, such as an error that
+// quotes the connection string.
+func redact(text string) string {
+	text = userinfoPattern.ReplaceAllString(text, "://"+redacted+"@")
+	return secretPattern.ReplaceAllString(text, "${1}${2}"+redacted)
+}
+
+// check runs the diagnosis of connString, writing its report to w.
+func check(ctx context.Context, connString string, w io.Writer) error {
+	cfg, err := pqtimeouts.ParseConfig(connString)
+	if err != nil {
+		return err
+	}
+	settings, err := pqtimeouts.ParseSettings(cfg.ConnString)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Settings:")
+	inline := lookup(settings, "sslinline", "false") == "true"
+	for _, s := range settings {
+		value := s.Value
+		if secret(s.Key, inline) {
+			value = redacted
+		}
+		fmt.Fprintf(w, "  %s=%s\n", s.Key, value)
+	}
+	for _, t := range timeouts(cfg, settings) {
+		if t.name != "connect_timeout" { // Already listed with the lib/pq settings
+			fmt.Fprintf(w, "  %s=%v\n", t.name, t.limit)
+		}
+	}
+
+	fmt.Fprintln(w, "Phases:")
+	host := lookup(settings, "host", os.Getenv("PGHOST"), "localhost")
+	if strings.HasPrefix(host, "/") {
+		fmt.Fprintf(w, "  %-9s skipped, %s is a unix socket\n", "resolve", host)
+	} else {
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %w", host, err)
+		}
+		fmt.Fprintf(w, "  %-9s %-12v %s -> %s\n", "resolve", round(time.Since(start)), host, strings.Join(addrs, ", "))
+	}
+
+	rec := &recorder{}
+	cfg.Tracer = rec
+	db := sql.OpenDB(pqtimeouts.NewConnector(cfg))
+	defer db.Close()
+
+	start := time.Now()
+	conn, connectErr := db.Conn(ctx)
+	connected := time.Now()
+	dial, tls := rec.span(pqtimeouts.SpanDial), rec.span(pqtimeouts.SpanTLS)
+	var m measurements
+	if dial != nil {
+		m.dial = dial.duration()
+		fmt.Fprintf(w, "  %-9s %-12v %s\n", "dial", round(m.dial), dial.attrs[pqtimeouts.AttrRemoteAddress])
+		start = dial.start.Add(m.dial)
+	}
+	if tls != nil {
+		accepted, _ := tls.attrs[pqtimeouts.AttrTLS].(bool)
+		m.tls = tls.duration()
+		fmt.Fprintf(w, "  %-9s %-12v accepted=%v", "tls", round(m.tls), accepted)
+		if version, ok := tls.attrs[pqtimeouts.AttrTLSVersion]; ok {
+			fmt.Fprintf(w, " %v %v", version, tls.attrs[pqtimeouts.AttrTLSCipher])
+		}
+		fmt.Fprintln(w)
+		start = tls.start.Add(m.tls)
+	}
+	if dial != nil && dial.err == nil {
+		m.startup = connected.Sub(start)
+		fmt.Fprintf(w, "  %-9s %v\n", "startup", round(m.startup))
+	}
+
+	err = connectErr
+	if err == nil {
+		defer conn.Close()
+		var one int
+		start := time.Now()
+		err = conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		m.query = time.Since(start)
+		fmt.Fprintf(w, "  %-9s %-12v SELECT 1\n", "query", round(m.query))
+	}
+	m.responseWait = rec.longestResponseWait()
+
+	fmt.Fprintln(w, "Timeouts:")
+	fired := firedTimeout(err)
+	for _, t := range timeouts(cfg, settings) {
+		fmt.Fprintf(w, "  %-28s %s\n", t.name, t.report(m, fired))
+	}
+	return err
+}
+
+// lookup returns the value of key in settings, or the first non-empty default.
+func lookup(settings []pqtimeouts.Setting, key string, defaults ...string) string {
+	for _, s := range settings {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	for _, d := range defaults {
+		if d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+// measurements are the durations of the phases of a check.
+type measurements struct {
+	dial         time.Duration
+	tls          time.Duration
+	startup      time.Duration
+	query        time.Duration
+	responseWait time.Duration // The longest wait for a response to start, on plaintext connections
+}
+
+// timeout is a configured timeout and the measurement it is compared with.
+type timeout struct {
+	name     string
+	limit    time.Duration
+	measured func(measurements) time.Duration
+}
+
+// timeouts returns the timeouts set in cfg and the lib/pq settings.
+func timeouts(cfg pqtimeouts.Config, settings []pqtimeouts.Setting) []timeout {
+	var list []timeout
+	if seconds, err := strconv.Atoi(lookup(settings, "connect_timeout")); err == nil && seconds > 0 {
+		list = append(list, timeout{"connect_timeout", time.Duration(seconds) * time.Second,
+			func(m measurements) time.Duration { return m.dial }})
+	}
+	for _, t := range []timeout{
+		{"read_timeout", cfg.ReadTimeout, func(m measurements) time.Duration { return m.responseWait }},
+		{"write_timeout", cfg.WriteTimeout, nil},
+		{"auth_timeout", cfg.AuthTimeout, func(m measurements) time.Duration { return m.startup }},
+		{"query_timeout", cfg.QueryTimeout, func(m measurements) time.Duration { return m.query }},
+		{"copy_timeout", cfg.CopyTimeout, nil},
+		{"idle_in_transaction_timeout", cfg.IdleInTransactionTimeout, nil},
+		{"tls_handshake_timeout", cfg.TLSHandshakeTimeout, func(m measurements) time.Duration { return m.tls }},
+	} {
+		if t.limit > 0 {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// report describes how close the measurement came to the timeout.
+func (t timeout) report(m measurements, fired string) string {
+	if fired == t.name {
+		return fmt.Sprintf("FIRED after %v", t.limit)
+	}
+	if t.measured == nil {
+		return fmt.Sprintf("%v, not measured", t.limit)
+	}
+	measured := t.measured(m)
+	if measured == 0 {
+		return fmt.Sprintf("%v, not measured", t.limit)
+	}
+	percent := int(100 * measured / t.limit)
+	switch {
+	case measured >= t.limit:
+		return fmt.Sprintf("WOULD FIRE: %v of %v", round(measured), t.limit)
+	case percent >= 80:
+		return fmt.Sprintf("CLOSE: %v of %v (%d%%)", round(measured), t.limit, percent)
+	}
+	return fmt.Sprintf("ok: %v of %v (%d%%)", round(measured), t.limit, percent)
+}
+
+// firedTimeout returns the name of the timeout that caused err, if any.
+func firedTimeout(err error) string {
+	var timeoutErr *pqtimeouts.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		if timeoutErr.Phase == pqtimeouts.PhaseThroughput {
+			return "min_throughput"
+		}
+		return string(timeoutErr.Phase) + "_timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		switch opErr.Op {
+		case "read":
+			return "read_timeout"
+		case "write":
+			return "write_timeout"
+		case "dial":
+			return "connect_timeout"
+		}
+	}
+	return ""
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// recorder is a Tracer keeping the spans of a check.
+type recorder struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+type span struct {
+	mu    sync.Mutex
+	name  string
+	start time.Time
+	end   time.Time
+	attrs map[string]any
+	err   error
+}
+
+func (r *recorder) Start(ctx context.Context, name string, attrs ...pqtimeouts.Attribute) (context.Context, pqtimeouts.Span) {
+	s := &span{name: name, start: time.Now(), attrs: make(map[string]any)}
+	s.SetAttributes(attrs...)
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return ctx, s
+}
+
+// span returns the first span called name, or nil.
+func (r *recorder) span(name string) *span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// longestResponseWait returns the longest time a round trip waited for its response to start.
+func (r *recorder) longestResponseWait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var longest time.Duration
+	for _, s := range r.spans {
+		s.mu.Lock()
+		wait, _ := s.attrs[pqtimeouts.AttrResponseWait].(time.Duration)
+		s.mu.Unlock()
+		if wait > longest {
+			longest = wait
+		}
+	}
+	return longest
+}
+
+func (s *span) SetAttributes(attrs ...pqtimeouts.Attribute) {
+	s.mu.Lock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+	s.mu.Unlock()
+}
+
+func (s *span) RecordError(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *span) duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		return time.Since(s.start)
+	}
+	return s.end.Sub(s.start)
+}
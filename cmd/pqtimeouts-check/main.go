@@ -0,0 +1,45 @@
+// Command pqtimeouts-check diagnoses a pq-timeouts connection string. It prints the parsed settings with passwords and
+// inline keys redacted, resolves the host, dials it, runs the startup handshake and a SELECT 1, and reports how long
+// each phase took and which timeouts fired or came close. Errors are printed with secrets redacted too.
+//
+//	pqtimeouts-check "host=db1 user=app password=secret read_timeout=500 connect_timeout=5"
+//
+// It exits with status 1 if the check fails.
+//
+// The validate subcommand only parses the connection string, and lists settings that conflict or are risky without
+// connecting. It exits with status 1 if there are any warnings:
+//
+//	pqtimeouts-check validate "host=db1 user=app read_timeout=500 options='-c statement_timeout=5s'"
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", time.Minute, "The most the whole check may take")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <connection string>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s validate <connection string>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 2 && flag.Arg(0) == "validate" {
+		os.Exit(validate(flag.Arg(1), os.Stdout))
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := check(ctx, flag.Arg(0), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stdout, "FAILED: %s\n", redact(err.Error()))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+)
+
+// validate writes the warnings for connString to w, returning the exit status: 0 when there are none, 1 when there
+// are warnings and 2 when the connection string can't be parsed.
+func validate(connString string, w io.Writer) int {
+	warnings, err := pqtimeouts.Validate(connString)
+	if err != nil {
+		fmt.Fprintf(w, "INVALID: %s\n", redact(err.Error()))
+		return 2
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+	if len(warnings) > 0 {
+		return 1
+	}
+	fmt.Fprintln(w, "OK")
+	return 0
+}
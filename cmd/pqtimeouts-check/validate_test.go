@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	var out bytes.Buffer
+	if status := validate("user=pqtest connect_timeout=5 read_timeout=500", &out); status != 0 {
+		t.Errorf("Expected status 0, got %d:\n%s", status, out.String())
+	}
+
+	out.Reset()
+	if status := validate("user=pqtest read_timeout=500 statement_timeout=1000", &out); status != 1 {
+		t.Errorf("Expected status 1, got %d:\n%s", status, out.String())
+	}
+	if !strings.Contains(out.String(), "WARNING: read_timeout:") ||
+		!strings.Contains(out.String(), "WARNING: connect_timeout:") {
+		t.Errorf("Expected read_timeout and connect_timeout warnings:\n%s", out.String())
+	}
+
+	out.Reset()
+	if status := validate("user=pqtest read_timeout=soon", &out); status != 2 {
+		t.Errorf("Expected status 2, got %d:\n%s", status, out.String())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handler returns the HTTP control API of the proxy. Changes are made with POST and query parameters, and every
+// endpoint responds with the status.
+func (p *proxy) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		p.writeStatus(w)
+	})
+	mux.HandleFunc("/latency", p.change(func(f *faults, r *http.Request) error {
+		var err error
+		if f.Latency, err = durationParam(r, "latency", f.Latency); err != nil {
+			return err
+		}
+		f.Jitter, err = durationParam(r, "jitter", f.Jitter)
+		return err
+	}))
+	mux.HandleFunc("/bandwidth", p.change(func(f *faults, r *http.Request) error {
+		var err error
+		if f.ReadRate, err = floatParam(r, "read", f.ReadRate); err != nil {
+			return err
+		}
+		f.WriteRate, err = floatParam(r, "write", f.WriteRate)
+		return err
+	}))
+	mux.HandleFunc("/blackhole", p.change(func(f *faults, r *http.Request) error {
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			return fmt.Errorf("invalid value for on: %q", r.FormValue("on"))
+		}
+		f.Blackhole = on
+		return nil
+	}))
+	mux.HandleFunc("/clear", p.change(func(f *faults, r *http.Request) error {
+		*f = faults{}
+		return nil
+	}))
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		p.reset()
+		p.writeStatus(w)
+	})
+	return mux
+}
+
+// change returns a handler applying update to the current faults.
+func (p *proxy) change(update func(*faults, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		f := p.current()
+		if err := update(&f, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.set(f)
+		p.writeStatus(w)
+	}
+}
+
+func (p *proxy) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		faults
+		Connections int `json:"connections"`
+	}{p.current(), p.connections()})
+}
+
+// durationParam returns the duration in the query parameter name, or def if it is missing.
+func durationParam(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return d, nil
+}
+
+// floatParam returns the number in the query parameter name, or def if it is missing.
+func floatParam(r *http.Request, name string, def float64) (float64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", name, v)
+	}
+	return f, nil
+}
@@ -0,0 +1,58 @@
+// Command pqtimeouts-proxy forwards TCP connections to a Postgres server while injecting network faults, for testing
+// how clients and whole stacks behave on a degraded link.
+//
+//	pqtimeouts-proxy -listen 127.0.0.1:6432 -upstream db1:5432 -control 127.0.0.1:6480
+//
+// Faults are changed while the proxy runs through its HTTP control API:
+//
+//	curl -X POST '127.0.0.1:6480/latency?latency=200ms&jitter=50ms'
+//	curl -X POST '127.0.0.1:6480/bandwidth?read=10000&write=5000'
+//	curl -X POST '127.0.0.1:6480/blackhole?on=true'
+//	curl -X POST '127.0.0.1:6480/reset'
+//	curl -X POST '127.0.0.1:6480/clear'
+//	curl '127.0.0.1:6480/status'
+//
+// On Unix, SIGUSR1 toggles the blackhole and SIGUSR2 resets all connections.
+//
+// The upstream side of each connection is dialed through a pq-timeouts Connector, so the -settings flag takes the
+// pq-timeouts connection string settings, such as query_timeout, that apply to it. The proxy reads from the server for
+// as long as the client is connected, so read_timeout ends any session idle for longer than it; phase timeouts such as
+// query_timeout and auth_timeout only apply while the server owes a response.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:6432", "The address to accept client connections on")
+	upstream := flag.String("upstream", "127.0.0.1:5432", "The address of the Postgres server")
+	control := flag.String("control", "127.0.0.1:6480", "The address of the HTTP control API, or empty for none")
+	settings := flag.String("settings", "", "pq-timeouts settings for the upstream connections, such as query_timeout=5000")
+	flag.Parse()
+
+	cfg, err := pqtimeouts.ParseConfig(*settings)
+	if err != nil {
+		log.Fatalf("pqtimeouts-proxy: %v", err)
+	}
+	p := newProxy(cfg, *upstream)
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("pqtimeouts-proxy: %v", err)
+	}
+	if *control != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*control, p.handler()))
+		}()
+	}
+	handleSignals(p)
+
+	log.Printf("pqtimeouts-proxy: forwarding %s to %s", l.Addr(), *upstream)
+	log.Fatal(p.serve(l))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+)
+
+// faults are the faults the proxy is currently injecting.
+type faults struct {
+	Latency   time.Duration `json:"latency"`
+	Jitter    time.Duration `json:"jitter"`
+	ReadRate  float64       `json:"read_rate"`  // Bytes per second from the server, or 0 for no limit
+	WriteRate float64       `json:"write_rate"` // Bytes per second to the server, or 0 for no limit
+	Blackhole bool          `json:"blackhole"`
+}
+
+// proxy forwards client connections to the upstream server.
+type proxy struct {
+	upstream     string
+	connector    *pqtimeouts.Connector
+	chaos        *pqtimeouts.Chaos
+	readLimiter  *pqtimeouts.RateLimiter
+	writeLimiter *pqtimeouts.RateLimiter
+
+	mu       sync.Mutex
+	faults   faults
+	sessions map[*session]bool
+}
+
+// session is a client connection and the upstream connection it is forwarded to.
+type session struct {
+	client   net.Conn
+	upstream net.Conn
+}
+
+func newProxy(cfg pqtimeouts.Config, upstream string) *proxy {
+	p := &proxy{
+		upstream:     upstream,
+		chaos:        pqtimeouts.NewChaos(pqtimeouts.ChaosConfig{}),
+		readLimiter:  pqtimeouts.NewRateLimiter(0, 0),
+		writeLimiter: pqtimeouts.NewRateLimiter(0, 0),
+		sessions:     make(map[*session]bool)}
+	cfg.Chaos = p.chaos
+	cfg.PoolReadLimiter = p.readLimiter
+	cfg.PoolWriteLimiter = p.writeLimiter
+	p.connector = pqtimeouts.NewConnector(cfg)
+	return p
+}
+
+// serve accepts client connections on l until it fails.
+func (p *proxy) serve(l net.Listener) error {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *proxy) forward(client net.Conn) {
+	upstream, err := p.connector.Dial("tcp", p.upstream)
+	if err != nil {
+		log.Printf("pqtimeouts-proxy: dialing %s failed: %v", p.upstream, err)
+		client.Close()
+		return
+	}
+
+	s := &session{client: client, upstream: upstream}
+	p.mu.Lock()
+	p.sessions[s] = true
+	p.mu.Unlock()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	// When either side stops, close the client and expire the upstream deadlines so the other copy ends too. The
+	// upstream connection is only closed once nothing is using it.
+	<-done
+	client.Close()
+	upstream.SetDeadline(time.Now())
+	<-done
+	upstream.Close()
+
+	p.mu.Lock()
+	delete(p.sessions, s)
+	p.mu.Unlock()
+}
+
+// set changes the faults being injected.
+func (p *proxy) set(f faults) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.faults = f
+	cfg := pqtimeouts.ChaosConfig{Latency: f.Latency, Jitter: f.Jitter}
+	if f.Blackhole {
+		cfg.StallProbability = 1
+	}
+	p.chaos.Set(cfg)
+	p.readLimiter.SetRate(f.ReadRate, 0)
+	p.writeLimiter.SetRate(f.WriteRate, 0)
+}
+
+// current returns the faults being injected.
+func (p *proxy) current() faults {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.faults
+}
+
+// connections returns the number of connections being forwarded.
+func (p *proxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// reset drops every connection being forwarded, sending the client a TCP reset rather than a clean close. The
+// upstream connections are closed as their sessions end.
+func (p *proxy) reset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for s := range p.sessions {
+		if tcp, ok := s.client.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		s.client.Close()
+	}
+	return len(p.sessions)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+// startProxy starts a proxy in front of srv with upstream settings cfg, returning it and a connection string for it.
+func startProxy(t *testing.T, srv *pqtimeoutstest.Server, cfg pqtimeouts.Config) (*proxy, string) {
+	p := newProxy(cfg, srv.Addr())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go p.serve(l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return p, "host=" + host + " port=" + port + " user=pqtest dbname=pqtest sslmode=disable"
+}
+
+func TestProxyForwards(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT 1", pqtimeoutstest.Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	_, connString := startProxy(t, srv, pqtimeouts.Config{})
+
+	db, err := sql.Open("pq-timeouts", connString+" read_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expected 1, got %d, %v", n, err)
+	}
+}
+
+func TestProxyIdleSession(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT 1", pqtimeoutstest.Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	cfg, err := pqtimeouts.ParseConfig("query_timeout=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, connString := startProxy(t, srv, cfg)
+
+	db, err := sql.Open("pq-timeouts", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A session idle for longer than the upstream query_timeout is kept.
+	for i := 0; i < 2; i++ {
+		var n int
+		if err := conn.QueryRowContext(context.Background(), "SELECT 1").Scan(&n); err != nil || n != 1 {
+			t.Errorf("Expected 1, got %d, %v", n, err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+func TestProxyBlackhole(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	p, connString := startProxy(t, srv, pqtimeouts.Config{})
+
+	db, err := sql.Open("pq-timeouts", connString+" read_timeout=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.set(faults{Blackhole: true})
+	_, err = db.Exec("SELECT 1")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout through the blackhole, got %v", err)
+	}
+}
+
+func TestProxyControl(t *testing.T) {
+	p := newProxy(pqtimeouts.Config{}, "127.0.0.1:5432")
+	handler := p.handler()
+
+	post := func(url string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, nil))
+		return w.Code
+	}
+
+	if code := post("/latency?latency=200ms&jitter=50ms"); code != http.StatusOK {
+		t.Errorf("Setting latency failed with %d", code)
+	}
+	if code := post("/bandwidth?read=1000"); code != http.StatusOK {
+		t.Errorf("Setting bandwidth failed with %d", code)
+	}
+	f := p.current()
+	if f.Latency != 200*time.Millisecond || f.Jitter != 50*time.Millisecond || f.ReadRate != 1000 || f.WriteRate != 0 {
+		t.Errorf("Faults were not as expected: %+v", f)
+	}
+
+	if code := post("/latency?latency=soon"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid latency to be rejected, got %d", code)
+	}
+	if code := post("/clear"); code != http.StatusOK || p.current() != (faults{}) {
+		t.Errorf("Clearing failed with %d: %+v", code, p.current())
+	}
+}
+
+func TestProxyReset(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	p, connString := startProxy(t, srv, pqtimeouts.Config{})
+
+	db, err := sql.Open("pq-timeouts", connString+" read_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if n := p.reset(); n != 1 {
+		t.Errorf("Expected 1 connection to be reset, got %d", n)
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT 1"); err == nil {
+		t.Error("Expected an error on a reset connection")
+	}
+}
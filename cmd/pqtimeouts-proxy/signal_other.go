@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// handleSignals does nothing where SIGUSR1 and SIGUSR2 don't exist; use the control API instead.
+func handleSignals(p *proxy) {
+}
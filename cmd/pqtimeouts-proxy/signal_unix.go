@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals toggles the blackhole on SIGUSR1 and resets all connections on SIGUSR2.
+func handleSignals(p *proxy) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				f := p.current()
+				f.Blackhole = !f.Blackhole
+				p.set(f)
+				log.Printf("pqtimeouts-proxy: blackhole %v", f.Blackhole)
+			case syscall.SIGUSR2:
+				log.Printf("pqtimeouts-proxy: reset %d connections", p.reset())
+			}
+		}
+	}()
+}
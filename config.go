@@ -0,0 +1,331 @@
+package pqtimeouts
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Config holds the settings pq-timeouts uses to open connections. ParseConfig builds one from a connection string;
+// fields that can't be expressed in a connection string, such as Collector, can be set before passing it to
+// NewConnector.
+type Config struct {
+	ConnString       string // The lib/pq connection string with the pq-timeouts settings removed
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	ApplicationName  string // The application_name from ConnString, used to label metrics
+	ProtocolTracking bool   // Follow the protocol state of each connection, set by protocol_tracking
+
+	// TCPKeepAlive is the period of TCP keepalive probes on the connections pq-timeouts dials, set by tcp_keepalive in
+	// milliseconds. 0 uses Go's default of 15s, and a negative value turns keepalives off. lib/pq doesn't support
+	// libpq's keepalives settings, and sends them to the server, which refuses the connection.
+	TCPKeepAlive time.Duration
+
+	// HostTimeouts overrides the read, write, idle in transaction and connect timeouts of connections to some hosts,
+	// so one Connector can serve targets with different latencies. The first entry matching the host name or IP
+	// address dialed, or with a CIDR block containing the address connected to, applies.
+	HostTimeouts []HostTimeouts
+
+	// Timeouts for phases of a session, which need protocol tracking and turn it on when set. They are enforced on the
+	// client: a phase that takes too long fails with a TimeoutError and the connection is dropped.
+	AuthTimeout              time.Duration // From the startup message until the server is first ready
+	QueryTimeout             time.Duration // From sending a query until the server is ready again, excluding COPY
+	CopyTimeout              time.Duration // For the COPY data of a query
+	IdleInTransactionTimeout time.Duration // Between statements inside a transaction, checked at the next statement
+
+	// In buffered mode, connections coalesce messages the server doesn't answer, such as Parse, Bind and Execute,
+	// until one it does, such as Sync, and read into a buffer, so each batch is one write or read with one deadline.
+	// BufferSize defaults to DefaultBufferSize.
+	Buffered   bool
+	BufferSize int
+
+	// With SQLHints set to SQLHintsKeep or SQLHintsStrip, a comment such as /*+ pqtimeouts read_timeout=10s */ at the
+	// start of a statement sets its read_timeout or write_timeout, as WithReadTimeout and WithWriteTimeout do. A
+	// context's timeouts take precedence. SQLHintsStrip removes the comment before the statement is sent.
+	SQLHints string
+
+	// Server timeouts derived from the client timeouts, so the server gives up at about the same time as the client
+	// rather than running a statement nobody is waiting for. They are sent in options, less ServerTimeoutMargin so the
+	// server gives up first and the connection stays usable. ServerStatementTimeout sets statement_timeout and
+	// ServerLockTimeout sets lock_timeout from QueryTimeout, or ReadTimeout when it is 0.
+	// ServerIdleInTransactionTimeout sets idle_in_transaction_session_timeout from IdleInTransactionTimeout. Server
+	// timeouts already in the connection string are kept.
+	ServerStatementTimeout         bool
+	ServerLockTimeout              bool
+	ServerIdleInTransactionTimeout bool
+	ServerTimeoutMargin            time.Duration // Defaults to DefaultServerTimeoutMargin
+
+	// Queries taking at least SlowThreshold are passed to SlowQueryHandler and logged. Setting it turns on protocol
+	// tracking.
+	SlowThreshold     time.Duration
+	RedactSlowQueries bool // Replace literals in the SQL of slow queries with ?, set by slow_query_redact
+	SlowQueryHandler  SlowQueryHandler
+
+	// With AdaptiveReadTimeout, each read's timeout is AdaptiveMultiplier times the AdaptivePercentile of how long
+	// recent responses from the same host took to start arriving, bounded by AdaptiveMinReadTimeout and
+	// AdaptiveMaxReadTimeout. The minimum defaults to DefaultAdaptiveMinReadTimeout, and the maximum to ReadTimeout,
+	// which is used until enough responses have been seen.
+	AdaptiveReadTimeout    bool
+	AdaptivePercentile     float64 // Defaults to DefaultAdaptivePercentile
+	AdaptiveMultiplier     float64 // Defaults to DefaultAdaptiveMultiplier
+	AdaptiveMinReadTimeout time.Duration
+	AdaptiveMaxReadTimeout time.Duration
+
+	// With MinThroughput, in bytes per second, a response read slower than that over ThroughputWindow for longer than
+	// ThroughputGrace fails with a TimeoutError. Only time spent waiting on the network counts. Setting it turns on
+	// protocol tracking.
+	MinThroughput    float64
+	ThroughputWindow time.Duration // Defaults to DefaultThroughputWindow
+	ThroughputGrace  time.Duration // Defaults to DefaultThroughputGrace
+
+	// Bandwidth limits in bytes per second, for each connection and shared by all connections from a Connector. Time
+	// spent waiting on a limiter isn't counted against read and write timeouts.
+	ReadRateLimit      float64
+	WriteRateLimit     float64
+	PoolReadRateLimit  float64
+	PoolWriteRateLimit float64
+
+	// Limiters shared by all connections from a Connector, used instead of the pool rate limits when set so the limit
+	// can be changed with SetRate.
+	PoolReadLimiter  *RateLimiter
+	PoolWriteLimiter *RateLimiter
+
+	// With a liveness probe, a read that times out while waiting for a response checks the backend is alive instead of
+	// failing, and waits another ReadTimeout if it is. LivenessProber takes precedence over LivenessProbe, which names
+	// a built in prober: "tcp" or "pg_stat_activity".
+	LivenessProbe        string
+	LivenessProber       LivenessProber
+	LivenessProbeTimeout time.Duration // Defaults to DefaultLivenessProbeTimeout
+	LivenessMax          time.Duration // The most a read's deadline is extended by. Defaults to DefaultLivenessMax
+
+	// With TLSConfig, TLSHandshakeTimeout or CertificateProvider, pq-timeouts negotiates TLS itself instead of lib/pq,
+	// following sslmode. TLSConfig defaults to one built from sslmode, sslcert, sslkey and sslrootcert. The SSLRequest
+	// and handshake together are bounded by TLSHandshakeTimeout, or ReadTimeout when it is 0, and fail with a
+	// TimeoutError. CertificateProvider is consulted on each dial for client certificates and root certificate
+	// authorities, which replace those of TLSConfig. It defaults to a FileCertificates reading sslcert, sslkey and
+	// sslrootcert when TLSConfig isn't set.
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration
+	CertificateProvider CertificateProvider
+
+	Collector Collector  // Receives connection metrics when set
+	Logger    Logger     // Receives connection and timeout events when set
+	LogLevel  slog.Level // The minimum level of events sent to Logger, set by log_level
+	Tracer    Tracer     // Creates spans for dials, TLS upgrades and round trips when set
+	Chaos     *Chaos     // Injects faults into connections when set, for testing
+}
+
+// ParseConfig parses a lib/pq connection string or URL containing pq-timeouts settings. Values may be single quoted,
+// as newer lib/pq versions write them when converting a URL.
+func ParseConfig(connection string) (cfg Config, err error) {
+	// Look for read_timeout and write_timeout in the connection string and extract the values.
+	// read_timeout and write_timeout need to be removed from the connection string before calling pq as well.
+	var newConnectionSettings []string
+
+	// If the connection is specified as a URL, use the parsing function in lib/pq to turn it into options.
+	if strings.HasPrefix(connection, "postgres://") || strings.HasPrefix(connection, "postgresql://") {
+		connection, err = pq.ParseURL(connection)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	settings, err := ParseSettings(connection)
+	var missing *missingValueError
+	if errors.As(err, &missing) {
+		return Config{}, fmt.Errorf("Error interpreting value for %s", missing.key)
+	} else if err != nil {
+		return Config{}, err
+	}
+
+	for _, setting := range settings {
+		s := []string{setting.Key, setting.Value}
+		switch s[0] {
+		case "read_timeout":
+			if cfg.ReadTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "write_timeout":
+			if cfg.WriteTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "tcp_keepalive":
+			if cfg.TCPKeepAlive, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "auth_timeout":
+			if cfg.AuthTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "query_timeout":
+			if cfg.QueryTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "copy_timeout":
+			if cfg.CopyTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "idle_in_transaction_timeout":
+			if cfg.IdleInTransactionTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "server_statement_timeout":
+			if cfg.ServerStatementTimeout, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "server_lock_timeout":
+			if cfg.ServerLockTimeout, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "server_idle_in_transaction_timeout":
+			if cfg.ServerIdleInTransactionTimeout, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "server_timeout_margin":
+			if cfg.ServerTimeoutMargin, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "buffered":
+			if cfg.Buffered, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "sql_hints":
+			if len(s) != 2 || (s[1] != SQLHintsKeep && s[1] != SQLHintsStrip) {
+				return Config{}, fmt.Errorf("Error interpreting value for sql_hints")
+			}
+			cfg.SQLHints = s[1]
+		case "slow_threshold":
+			if cfg.SlowThreshold, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "slow_query_redact":
+			if cfg.RedactSlowQueries, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "adaptive_read_timeout":
+			if cfg.AdaptiveReadTimeout, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "adaptive_percentile":
+			if cfg.AdaptivePercentile, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "adaptive_multiplier":
+			if cfg.AdaptiveMultiplier, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "adaptive_min_read_timeout":
+			if cfg.AdaptiveMinReadTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "adaptive_max_read_timeout":
+			if cfg.AdaptiveMaxReadTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "min_throughput":
+			if cfg.MinThroughput, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "throughput_window":
+			if cfg.ThroughputWindow, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "throughput_grace":
+			if cfg.ThroughputGrace, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "read_rate_limit":
+			if cfg.ReadRateLimit, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "write_rate_limit":
+			if cfg.WriteRateLimit, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "pool_read_rate_limit":
+			if cfg.PoolReadRateLimit, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "pool_write_rate_limit":
+			if cfg.PoolWriteRateLimit, err = parseFloat(s); err != nil {
+				return Config{}, err
+			}
+		case "liveness_probe":
+			if len(s) != 2 || (s[1] != LivenessProbeTCP && s[1] != LivenessProbePGStatActivity) {
+				return Config{}, fmt.Errorf("Error interpreting value for liveness_probe")
+			}
+			cfg.LivenessProbe = s[1]
+		case "liveness_probe_timeout":
+			if cfg.LivenessProbeTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "liveness_max":
+			if cfg.LivenessMax, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "tls_handshake_timeout":
+			if cfg.TLSHandshakeTimeout, err = parseMilliseconds(s); err != nil {
+				return Config{}, err
+			}
+		case "protocol_tracking":
+			if cfg.ProtocolTracking, err = parseBool(s); err != nil {
+				return Config{}, err
+			}
+		case "log_level":
+			if len(s) != 2 || cfg.LogLevel.UnmarshalText([]byte(s[1])) != nil {
+				return Config{}, fmt.Errorf("Error interpreting value for log_level")
+			}
+		case "application_name":
+			// application_name is also needed by lib/pq, so keep it in the connection string.
+			cfg.ApplicationName = setting.Value
+			newConnectionSettings = append(newConnectionSettings, setting.String())
+		default:
+			newConnectionSettings = append(newConnectionSettings, setting.String())
+		}
+	}
+
+	cfg.ConnString = strings.Join(newConnectionSettings, " ")
+	return cfg, nil
+}
+
+// parseBool interprets the value of a split key=value setting as a boolean.
+func parseBool(s []string) (bool, error) {
+	if len(s) != 2 {
+		return false, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	val, err := strconv.ParseBool(s[1])
+	if err != nil {
+		return false, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	return val, nil
+}
+
+// parseFloat interprets the value of a split key=value setting as a number.
+func parseFloat(s []string) (float64, error) {
+	if len(s) != 2 {
+		return 0, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	val, err := strconv.ParseFloat(s[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	return val, nil
+}
+
+// parseMilliseconds interprets the value of a split key=value setting as a number of milliseconds.
+func parseMilliseconds(s []string) (time.Duration, error) {
+	if len(s) != 2 {
+		return 0, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	val, err := strconv.Atoi(s[1])
+	if err != nil {
+		return 0, fmt.Errorf("Error interpreting value for %s", s[0])
+	}
+	return time.Duration(val) * time.Millisecond, nil // timeout is in milliseconds
+}
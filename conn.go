@@ -1,8 +1,13 @@
 package pqtimeouts
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,86 +19,320 @@ func (e nilConnErr) Error() string {
 }
 
 type timeoutConn struct {
-	conn         net.Conn
-	readTimeout  time.Duration
-	writeTimeout time.Duration
+	conn          net.Conn
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	collector     Collector
+	logger        eventLogger
+	labels        Labels
+	network       string
+	address       string
+	opened        time.Time
+	bytesRead     int64
+	bytesWritten  int64
+	operation     atomic.Pointer[operation] // The operation using the connection
+	hints         *hintTracker              // Applies timeout hints in SQL comments when set
+	live          *liveTimeouts             // Used in place of the timeouts above when set
+	host          *HostTimeouts             // Overrides the timeouts above for this host when set
+	readDeadline  armedDeadline
+	writeDeadline armedDeadline
+	readBuffer    *readBuffer  // Set in buffered mode
+	writeBuffer   *writeBuffer // Set in buffered mode
+	lifecycle     connLifecycle
+	idleTimer     idleTimer // Closes the connection when it is idle in a transaction for too long
+	protocol      *protocolTracker
+	phaseTimeouts phaseTimeouts
+	adaptive      *hostLatency // Learns the read timeout when set
+	awaiting      atomic.Bool  // Data was written and nothing has been read since, so a response is awaited
+	throughput    *throughputMonitor
+	liveness      *liveness
+	tlsConn       *tls.Conn // The connection under this one when pq-timeouts negotiated TLS
+	readLimiters  rateLimiters
+	writeLimiters rateLimiters
+	trace         *connTrace
 }
 
 func (t *timeoutConn) Read(b []byte) (n int, err error) {
-	if t.conn != nil {
-		if t.readTimeout != 0 {
-			// Set a read deadline before we call read.
-			t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	if t.conn != nil && t.lifecycle.begin() {
+		defer t.lifecycle.end(t.closed)
+		if t.writeBuffer != nil {
+			// Whatever is awaited can't arrive while the messages before it are still buffered.
+			if err := t.writeBuffer.flushPending(t.writeAll); err != nil {
+				return 0, err
+			}
 		}
-		n, err = t.conn.Read(b)
-		if t.readTimeout != 0 {
-			// Clear the deadline if we have one set
-			t.conn.SetReadDeadline(time.Time{})
+		if t.readBuffer != nil {
+			return t.readBuffer.read(b, t.read)
 		}
-		return
+		return t.read(b)
 	}
 	return 0, nilConnErr{}
 }
 
-func (t *timeoutConn) Write(b []byte) (n int, err error) {
-	if t.conn != nil {
-		if t.writeTimeout != 0 {
-			// Set a write deadline before we call write.
-			t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+// read reads into b with a single call to the underlying connection.
+func (t *timeoutConn) read(b []byte) (n int, err error) {
+	if len(t.readLimiters) > 0 {
+		// Wait for the limiters before the deadline is set, so the wait isn't counted against it.
+		allowed := t.readLimiters.wait(len(b))
+		b = b[:allowed]
+		defer func() { t.readLimiters.refund(allowed - n) }()
+	}
+	start := time.Now()
+	if t.protocol != nil {
+		t.protocol.readStarted()
+	}
+	// Only the wait for a response teaches adaptive timeouts anything. Waiting for notifications isn't waiting on a
+	// slow server.
+	learn := t.adaptive != nil && t.awaiting.Load() && t.State() != StateNotificationWait
+	readTimeout := t.currentReadTimeout()
+	deadline, phase := t.deadline(start, readTimeout)
+	streaming := t.throughput != nil && t.protocol.streaming()
+	if streaming {
+		deadline, phase = t.throughput.deadline(start, deadline, phase)
+	} else if t.throughput != nil {
+		t.throughput.pause()
+	}
+	// Set a read deadline before we call read, unless the one already set is close enough.
+	t.readDeadline.arm(t.conn.SetReadDeadline, start, deadline, phase)
+	n, err = t.conn.Read(b)
+	if t.liveness != nil && phase == PhaseNone && readTimeout != 0 {
+		n, err = t.liveness.retry(t, b, readTimeout, n, err)
+	}
+	t.readDeadline.done(t.conn.SetReadDeadline)
+	err = t.phaseError(err, phase)
+	if learn && n > 0 && t.awaiting.CompareAndSwap(true, false) {
+		t.adaptive.observe(time.Since(start))
+	}
+	if streaming && err == nil && !t.throughput.observe(time.Now(), n, time.Since(start)) {
+		err = &TimeoutError{Phase: PhaseThroughput, Limit: t.throughput.grace}
+	}
+	t.bytesRead += int64(n)
+	t.afterIO(readDirection, readTimeout, start, n, err)
+	if t.protocol != nil {
+		step := t.protocol.read(b[:n])
+		if t.trace != nil {
+			t.trace.read(step, n, err)
 		}
-		n, err = t.conn.Write(b)
-		if t.writeTimeout != 0 {
-			// Clear the deadline if we have one set
-			t.conn.SetWriteDeadline(time.Time{})
+		t.armIdleInTransaction()
+	}
+	return
+}
+
+func (t *timeoutConn) Write(b []byte) (n int, err error) {
+	if t.conn != nil && t.lifecycle.begin() {
+		defer t.lifecycle.end(t.closed)
+		if t.hints != nil {
+			// Apply hints before the write is split up, so whole messages are seen.
+			if rewritten := t.hints.rewrite(b); len(rewritten) != len(b) {
+				if _, err = t.writeBuffered(rewritten); err != nil {
+					return 0, err
+				}
+				return len(b), nil
+			}
 		}
-		return
+		return t.writeBuffered(b)
+	}
+	if err := t.idleTimer.expired(); err != nil {
+		return 0, err
 	}
 	return 0, nilConnErr{}
 }
 
+// writeBuffered writes b, or buffers it in buffered mode until a message the server answers is written.
+func (t *timeoutConn) writeBuffered(b []byte) (n int, err error) {
+	if t.writeBuffer != nil {
+		return t.writeBuffer.write(b, t.writeAll)
+	}
+	return t.writeAll(b)
+}
+
+// writeAll writes b, waiting for any rate limiters.
+func (t *timeoutConn) writeAll(b []byte) (n int, err error) {
+	if len(t.writeLimiters) == 0 {
+		return t.write(b)
+	}
+	// Wait for the limiters before writing each piece, so the wait isn't counted against the write deadline.
+	for n < len(b) && err == nil {
+		allowed := t.writeLimiters.wait(len(b) - n)
+		var written int
+		written, err = t.write(b[n : n+allowed])
+		t.writeLimiters.refund(allowed - written)
+		n += written
+		if written < allowed && err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	return
+}
+
+// write writes b with a single call to the underlying connection.
+func (t *timeoutConn) write(b []byte) (n int, err error) {
+	start := time.Now()
+	writeTimeout := t.currentWriteTimeout()
+	if t.protocol != nil {
+		t.idleTimer.stop()
+	}
+	if t.idleInTransactionExceeded(start) {
+		// The server would otherwise keep the transaction open, so give up on the connection.
+		err = &TimeoutError{Phase: PhaseIdleInTransaction, Limit: t.currentTimeouts().IdleInTransaction}
+		t.afterIO(writeDirection, writeTimeout, start, 0, err)
+		t.idleTimer.closedWith(err)
+		t.Close()
+		return 0, err
+	}
+	deadline, phase := t.deadline(start, writeTimeout)
+	// Set a write deadline before we call write, unless the one already set is close enough.
+	t.writeDeadline.arm(t.conn.SetWriteDeadline, start, deadline, phase)
+	n, err = t.conn.Write(b)
+	t.writeDeadline.done(t.conn.SetWriteDeadline)
+	if t.adaptive != nil && n > 0 {
+		t.awaiting.Store(true)
+	}
+	err = t.phaseError(err, phase)
+	t.bytesWritten += int64(n)
+	t.afterIO(writeDirection, writeTimeout, start, n, err)
+	if t.protocol != nil {
+		step := t.protocol.wrote(b[:n])
+		if t.trace != nil {
+			t.trace.wrote(t.context(), step, start, n, err)
+		}
+	}
+	return
+}
+
+// Close closes the connection. It may be called from another goroutine while a read or write is in progress, which
+// then fails. A connection that fails to close can be closed again.
 func (t *timeoutConn) Close() (err error) {
 	if t.conn != nil {
-		err = t.conn.Close()
-		if err == nil {
-			// If the close looked successful, set the connection to nil
-			t.conn = nil
+		if ok, err := t.lifecycle.close(t.conn.Close, t.closed); ok {
+			return err
 		}
-		return
 	}
 	return nilConnErr{}
 }
 
+// closed reports a closed connection, once no read or write is in progress.
+func (t *timeoutConn) closed() {
+	t.idleTimer.stop()
+	if t.trace != nil {
+		t.trace.close(t.protocol.currentSSL())
+	}
+	if t.collector != nil {
+		t.collector.Add(MetricConnectionsClosed, t.labels, 1)
+	}
+	t.logger.log(slog.LevelDebug, "pqtimeouts: connection closed", "host", t.labels.Host,
+		"bytes_read", t.bytesRead, "bytes_written", t.bytesWritten, "duration", time.Since(t.opened))
+}
+
+// usable reports whether the connection is open.
+func (t *timeoutConn) usable() bool {
+	return t.conn != nil && !t.lifecycle.closed()
+}
+
 func (t *timeoutConn) LocalAddr() net.Addr {
-	if t.conn != nil {
+	if t.usable() {
 		return t.conn.LocalAddr()
 	}
 	return nil
 }
 
 func (t *timeoutConn) RemoteAddr() net.Addr {
-	if t.conn != nil {
+	if t.usable() {
 		return t.conn.RemoteAddr()
 	}
 	return nil
 }
 
 func (t *timeoutConn) SetDeadline(time time.Time) error {
-	if t.conn != nil {
+	if t.usable() {
+		t.readDeadline.setExternal(time)
+		t.writeDeadline.setExternal(time)
 		return t.conn.SetDeadline(time)
 	}
 	return nilConnErr{}
 }
 
 func (t *timeoutConn) SetReadDeadline(time time.Time) error {
-	if t.conn != nil {
+	if t.usable() {
+		t.readDeadline.setExternal(time)
 		return t.conn.SetReadDeadline(time)
 	}
 	return nilConnErr{}
 }
 
 func (t *timeoutConn) SetWriteDeadline(time time.Time) error {
-	if t.conn != nil {
+	if t.usable() {
+		t.writeDeadline.setExternal(time)
 		return t.conn.SetWriteDeadline(time)
 	}
 	return fmt.Errorf("Connection is nil")
 }
+
+// State returns the protocol state of the connection. It is StateUnknown unless protocol tracking is on.
+func (t *timeoutConn) State() ConnState {
+	if t.protocol == nil {
+		return StateUnknown
+	}
+	return t.protocol.currentState()
+}
+
+// setContext sets the context of the operation about to use the connection, and the timeouts it gives.
+func (t *timeoutConn) setContext(ctx context.Context) {
+	t.operation.Store(&operation{ctx: ctx, override: overrideFrom(ctx)})
+}
+
+func (t *timeoutConn) context() context.Context {
+	if op := t.operation.Load(); op != nil && op.ctx != nil {
+		return op.ctx
+	}
+	return context.Background()
+}
+
+// override returns the timeouts given by the context of the current operation.
+func (t *timeoutConn) override() timeoutOverride {
+	if op := t.operation.Load(); op != nil {
+		return op.override
+	}
+	return timeoutOverride{}
+}
+
+// direction identifies which side of a connection an event happened on.
+type direction struct {
+	name           string
+	bytesMetric    string
+	durationMetric string
+	timeoutsMetric string
+}
+
+var (
+	readDirection  = direction{"read", MetricReadBytes, MetricReadDuration, MetricReadTimeouts}
+	writeDirection = direction{"write", MetricWrittenBytes, MetricWriteDuration, MetricWriteTimeouts}
+)
+
+// afterIO reports the outcome of a single Read or Write to the collector and logger.
+func (t *timeoutConn) afterIO(dir direction, timeout time.Duration, start time.Time, n int, err error) {
+	timedOut := isTimeout(err)
+	if t.collector != nil {
+		t.collector.Observe(dir.durationMetric, t.labels, time.Since(start).Seconds())
+		if n > 0 {
+			t.collector.Add(dir.bytesMetric, t.labels, float64(n))
+		}
+		if timedOut {
+			t.collector.Add(dir.timeoutsMetric, t.labels, 1)
+		}
+	}
+	if timedOut {
+		args := []any{"host", t.labels.Host, "direction", dir.name, "timeout", timeout, "elapsed", time.Since(start)}
+		if timeoutErr, ok := err.(*TimeoutError); ok {
+			args[5] = timeoutErr.Limit
+			args = append(args, "phase", string(timeoutErr.Phase))
+		}
+		t.logger.log(slog.LevelWarn, "pqtimeouts: timeout", args...)
+	}
+}
+
+// isTimeout reports whether err is a network timeout, such as a read or write deadline being exceeded.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
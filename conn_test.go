@@ -155,18 +155,15 @@ func TestReadTimeoutSet(t *testing.T) {
 		t.Error("Read should have been called but was not")
 	}
 
-	if testConn.setReadDeadlineCalled != 2 {
-		t.Error("SetReadDeadline should have been called twice and was not")
+	if testConn.setReadDeadlineCalled != 1 {
+		t.Error("SetReadDeadline should have been called once and was not")
 	}
 
+	// The deadline is left in place for the next read, rather than cleared.
 	emptyTime := time.Time{}
-	if testConn.setReadDeadlineTime != emptyTime {
+	if testConn.setReadDeadlineTime == emptyTime {
 		t.Errorf("Deadline time was not as expected: %+v", testConn.setReadDeadlineTime)
 	}
-
-	if testConn.setReadDeadlineTimePrev == emptyTime {
-		t.Errorf("Previous deadline time was unexpected: %+v", testConn.setReadDeadlineTimePrev)
-	}
 }
 
 func TestReadError(t *testing.T) {
@@ -185,18 +182,15 @@ func TestReadError(t *testing.T) {
 		t.Errorf("The error was not as expected: %q", err.Error())
 	}
 
-	if testConn.setReadDeadlineCalled != 2 {
-		t.Error("SetReadDeadline should have been called twice and was not")
+	if testConn.setReadDeadlineCalled != 1 {
+		t.Error("SetReadDeadline should have been called once and was not")
 	}
 
+	// The deadline is left in place for the next read, rather than cleared.
 	emptyTime := time.Time{}
-	if testConn.setReadDeadlineTime != emptyTime {
+	if testConn.setReadDeadlineTime == emptyTime {
 		t.Errorf("Deadline time was not as expected: %+v", testConn.setReadDeadlineTime)
 	}
-
-	if testConn.setReadDeadlineTimePrev == emptyTime {
-		t.Errorf("Previous deadline time was unexpected: %+v", testConn.setReadDeadlineTimePrev)
-	}
 }
 
 func TestWriteConnNil(t *testing.T) {
@@ -251,18 +245,15 @@ func TestWriteTimeoutSet(t *testing.T) {
 		t.Error("Write should have been called but was not")
 	}
 
-	if testConn.setWriteDeadlineCalled != 2 {
-		t.Error("SetWriteDeadline should have been called twice and was not")
+	if testConn.setWriteDeadlineCalled != 1 {
+		t.Error("SetWriteDeadline should have been called once and was not")
 	}
 
+	// The deadline is left in place for the next write, rather than cleared.
 	emptyTime := time.Time{}
-	if testConn.setWriteDeadlineTime != emptyTime {
+	if testConn.setWriteDeadlineTime == emptyTime {
 		t.Errorf("Deadline time was not as expected: %+v", testConn.setWriteDeadlineTime)
 	}
-
-	if testConn.setWriteDeadlineTimePrev == emptyTime {
-		t.Errorf("Previous deadline time was unexpected: %+v", testConn.setWriteDeadlineTimePrev)
-	}
 }
 
 func TestWriteError(t *testing.T) {
@@ -281,18 +272,15 @@ func TestWriteError(t *testing.T) {
 		t.Errorf("The error was not as expected: %q", err.Error())
 	}
 
-	if testConn.setWriteDeadlineCalled != 2 {
-		t.Error("SetWriteDeadline should have been called twice and was not")
+	if testConn.setWriteDeadlineCalled != 1 {
+		t.Error("SetWriteDeadline should have been called once and was not")
 	}
 
+	// The deadline is left in place for the next write, rather than cleared.
 	emptyTime := time.Time{}
-	if testConn.setWriteDeadlineTime != emptyTime {
+	if testConn.setWriteDeadlineTime == emptyTime {
 		t.Errorf("Deadline time was not as expected: %+v", testConn.setWriteDeadlineTime)
 	}
-
-	if testConn.setWriteDeadlineTimePrev == emptyTime {
-		t.Errorf("Previous deadline time was unexpected: %+v", testConn.setWriteDeadlineTimePrev)
-	}
 }
 
 func TestClose(t *testing.T) {
@@ -310,8 +298,12 @@ func TestClose(t *testing.T) {
 		t.Error("Close should have been called and was not")
 	}
 
-	if conn.conn != nil {
-		t.Error("The connection should have been set to nil and was not")
+	if conn.usable() {
+		t.Error("The connection should be closed and was not")
+	}
+
+	if err := conn.Close(); err == nil || err.Error() != "Connection is nil" {
+		t.Errorf("Closing again should fail: %v", err)
 	}
 }
 
@@ -348,8 +340,8 @@ func TestCloseError(t *testing.T) {
 		t.Errorf("Error was not as expected: %q", err.Error())
 	}
 
-	if conn.conn == nil {
-		t.Error("The connection should not be nil since there was an error")
+	if !conn.usable() {
+		t.Error("The connection should still be open since there was an error")
 	}
 }
 
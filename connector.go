@@ -0,0 +1,178 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Connector opens lib/pq connections using the settings in a Config. Use it with sql.OpenDB when a setting can't be
+// expressed in a connection string:
+//
+//	cfg, err := pqtimeouts.ParseConfig("user=pqtest dbname=pqtest read_timeout=500")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	cfg.Collector = registry
+//	db := sql.OpenDB(pqtimeouts.NewConnector(cfg))
+type Connector struct {
+	cfg      Config
+	dialOpen func(pq.Dialer, string) (driver.Conn, error) // Allow this to be stubbed for testing
+	adaptive *adaptiveTimeouts
+	liveness *liveness
+	tls      *tlsSettings
+	timeouts *liveTimeouts
+	hosts    *hostTable
+	err      error // Why the Config is invalid, returned by Connect
+
+	// Limiters shared by all connections, or nil
+	readLimiter  *RateLimiter
+	writeLimiter *RateLimiter
+}
+
+// NewConnector returns a Connector for cfg.
+func NewConnector(cfg Config) *Connector {
+	c := &Connector{cfg: cfg, dialOpen: pq.DialOpen, timeouts: newLiveTimeouts(Timeouts{
+		Read:              cfg.ReadTimeout,
+		Write:             cfg.WriteTimeout,
+		IdleInTransaction: cfg.IdleInTransactionTimeout})}
+	if cfg.AdaptiveReadTimeout {
+		max := cfg.AdaptiveMaxReadTimeout
+		if max == 0 {
+			max = cfg.ReadTimeout
+		}
+		c.adaptive = newAdaptiveTimeouts(adaptiveConfig{
+			percentile: cfg.AdaptivePercentile,
+			multiplier: cfg.AdaptiveMultiplier,
+			min:        cfg.AdaptiveMinReadTimeout,
+			max:        max})
+	}
+	c.readLimiter, c.writeLimiter = cfg.PoolReadLimiter, cfg.PoolWriteLimiter
+	if c.readLimiter == nil && cfg.PoolReadRateLimit > 0 {
+		c.readLimiter = NewRateLimiter(cfg.PoolReadRateLimit, 0)
+	}
+	if c.writeLimiter == nil && cfg.PoolWriteRateLimit > 0 {
+		c.writeLimiter = NewRateLimiter(cfg.PoolWriteRateLimit, 0)
+	}
+	c.liveness = newLiveness(cfg)
+	if tls, connString, err := newTLSSettings(cfg); err != nil {
+		c.err = err
+	} else {
+		c.tls, c.cfg.ConnString = tls, connString
+	}
+	if c.err == nil {
+		c.cfg.ConnString, c.err = withServerTimeouts(c.cfg)
+	}
+	if c.err == nil {
+		c.hosts, c.err = newHostTable(cfg.HostTimeouts)
+	}
+	return c
+}
+
+// Close releases what the Connector opened itself, such as the connection of a pg_stat_activity liveness probe.
+// sql.DB calls it when it is closed. Connections already open are unaffected.
+func (c *Connector) Close() error {
+	if c.liveness != nil {
+		return c.liveness.close()
+	}
+	return nil
+}
+
+// AdaptiveReadTimeout returns the read timeout currently learned for host, or 0 if adaptive read timeouts are off.
+func (c *Connector) AdaptiveReadTimeout(host string) time.Duration {
+	if c.adaptive == nil {
+		return 0
+	}
+	return c.adaptive.timeout(host)
+}
+
+// Connect opens a new connection to the database.
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var capture dialCapture
+	d := c.dialer()
+	d.ctx = ctx
+	d.onDial = capture.dialed
+
+	conn, err := c.dialOpen(d, c.cfg.ConnString)
+	tc := capture.finish()
+	if err != nil || conn == nil || tc == nil {
+		return conn, err
+	}
+	tc.setContext(nil)
+	return &driverConn{Conn: conn, tc: tc}, nil
+}
+
+// Dial opens a network connection to address with the timeouts, limits and reporting of the Connector, without
+// starting a Postgres session on it. It is for tools, such as proxies, that speak the protocol themselves.
+func (c *Connector) Dial(network, address string) (net.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.dialer().Dial(network, address)
+}
+
+// Driver returns the pq-timeouts driver.
+func (c *Connector) Driver() driver.Driver {
+	return timeoutDriver{dialOpen: c.dialOpen}
+}
+
+// bufferSize returns the size of connection buffers, or 0 when connections aren't buffered.
+func (c *Connector) bufferSize() int {
+	switch {
+	case !c.cfg.Buffered:
+		return 0
+	case c.cfg.BufferSize > 0:
+		return c.cfg.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+func (c *Connector) logger() eventLogger {
+	return eventLogger{logger: c.cfg.Logger, level: c.cfg.LogLevel}
+}
+
+func (c *Connector) dialer() timeoutDialer {
+	timeouts := c.timeouts.load()
+	keepAlive := c.cfg.TCPKeepAlive
+	return timeoutDialer{
+		netDial: (&net.Dialer{KeepAlive: keepAlive}).Dial,
+		netDialTimeout: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			return (&net.Dialer{Timeout: timeout, KeepAlive: keepAlive}).Dial(network, address)
+		},
+		readTimeout:     timeouts.Read,
+		writeTimeout:    timeouts.Write,
+		applicationName: c.cfg.ApplicationName,
+		collector:       c.cfg.Collector,
+		logger:          c.logger(),
+		tracer:          c.cfg.Tracer,
+		trackProtocol:   c.cfg.ProtocolTracking,
+		phaseTimeouts: phaseTimeouts{
+			auth:              c.cfg.AuthTimeout,
+			query:             c.cfg.QueryTimeout,
+			copy:              c.cfg.CopyTimeout,
+			idleInTransaction: timeouts.IdleInTransaction},
+		slowThreshold:     c.cfg.SlowThreshold,
+		redactSlowQueries: c.cfg.RedactSlowQueries,
+		slowQueryHandler:  c.cfg.SlowQueryHandler,
+		adaptive:          c.adaptive,
+		minThroughput:     c.cfg.MinThroughput,
+		throughputWindow:  c.cfg.ThroughputWindow,
+		throughputGrace:   c.cfg.ThroughputGrace,
+		readRateLimit:     c.cfg.ReadRateLimit,
+		writeRateLimit:    c.cfg.WriteRateLimit,
+		poolReadLimiter:   c.readLimiter,
+		poolWriteLimiter:  c.writeLimiter,
+		liveness:          c.liveness,
+		chaos:             c.cfg.Chaos,
+		sqlHints:          c.cfg.SQLHints,
+		live:              c.timeouts,
+		hosts:             c.hosts,
+		bufferSize:        c.bufferSize(),
+		tls:               c.tls}
+}
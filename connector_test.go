@@ -0,0 +1,95 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("user=pqtest read_timeout=700 write_timeout=800 application_name=reports dbname=pqtest")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if cfg.ConnString != "user=pqtest application_name=reports dbname=pqtest" {
+		t.Errorf("The connection string was not as expected: %q", cfg.ConnString)
+	}
+
+	if cfg.ReadTimeout != time.Duration(700)*time.Millisecond {
+		t.Error("Read timeout was not set to the correct duration")
+	}
+
+	if cfg.WriteTimeout != time.Duration(800)*time.Millisecond {
+		t.Error("Write timeout was not set to the correct duration")
+	}
+
+	if cfg.ApplicationName != "reports" {
+		t.Errorf("Application name was not as expected: %q", cfg.ApplicationName)
+	}
+}
+
+func TestParseConfigQuoted(t *testing.T) {
+	cfg, err := ParseConfig(`user=pqtest application_name='my app' read_timeout='700' password='it\'s'`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ApplicationName != "my app" {
+		t.Errorf("Application name was not as expected: %q", cfg.ApplicationName)
+	}
+	if cfg.ReadTimeout != 700*time.Millisecond {
+		t.Errorf("Read timeout was not as expected: %v", cfg.ReadTimeout)
+	}
+	if cfg.ConnString != `user=pqtest application_name='my app' password='it\'s'` {
+		t.Errorf("The connection string was not as expected: %q", cfg.ConnString)
+	}
+}
+
+func TestParseConfigMissingValue(t *testing.T) {
+	_, err := ParseConfig("user=pqtest read_timeout")
+
+	if err == nil || err.Error() != "Error interpreting value for read_timeout" {
+		t.Errorf("The error is unexpected: %v", err)
+	}
+}
+
+func TestConnectorConnect(t *testing.T) {
+	var connection string
+	var dialer pq.Dialer
+
+	registry := NewRegistry()
+	connector := NewConnector(Config{ConnString: "dbname=pqtest", ReadTimeout: time.Second, Collector: registry})
+	connector.dialOpen = func(d pq.Dialer, name string) (driver.Conn, error) {
+		connection = name
+		dialer = d
+		return nil, nil
+	}
+
+	if _, err := connector.Connect(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if connection != "dbname=pqtest" {
+		t.Errorf("The connection string was not as expected: %q", connection)
+	}
+
+	if toDialer, ok := dialer.(timeoutDialer); ok {
+		if toDialer.readTimeout != time.Second {
+			t.Error("Read timeout was not set to the correct duration")
+		}
+
+		if toDialer.collector != registry {
+			t.Error("Collector was not passed to the dialer")
+		}
+	} else {
+		t.Error("The dialer is not a timeoutDialer")
+	}
+
+	if _, ok := connector.Driver().(timeoutDriver); !ok {
+		t.Error("Driver is not a timeoutDriver")
+	}
+}
@@ -0,0 +1,95 @@
+package pqtimeouts
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// deadlineSlack is the fraction of a timeout by which a deadline already set may be later than needed and still be
+// kept. Arming deadlines this much later lets a run of small reads or writes share one, so a timeout may fire up to
+// 1/deadlineSlack of itself late.
+const deadlineSlack = 16
+
+// armedDeadline tracks the deadline set on one direction of a connection, so it is only changed when it would
+// materially differ, and isn't cleared after each read or write. A deadline set from outside, such as the one lib/pq
+// sets for connect_timeout, is kept: the deadline armed is never later than it.
+type armedDeadline struct {
+	at       time.Time
+	unknown  bool                      // The deadline set is not known, after an error setting it
+	external atomic.Pointer[time.Time] // The deadline last set through the timeoutConn, possibly from another goroutine
+	changed  atomic.Bool               // The external deadline changed since the last arm
+	exact    bool                      // Set the deadline before and clear it after every operation, to benchmark against
+}
+
+// setExternal records a deadline set through the timeoutConn. The caller sets it on the connection.
+func (a *armedDeadline) setExternal(at time.Time) {
+	a.external.Store(&at)
+	a.changed.Store(true)
+}
+
+// externalAt returns the deadline set through the timeoutConn, or the zero time if there is none.
+func (a *armedDeadline) externalAt() time.Time {
+	if at := a.external.Load(); at != nil {
+		return *at
+	}
+	return time.Time{}
+}
+
+// arm makes sure the deadline set with set falls between deadline and a little after it, for an operation starting at
+// now, or at the external deadline if that is earlier. A zero deadline leaves only the external deadline. Phase
+// deadlines don't move from one operation to the next, so they are set exactly.
+func (a *armedDeadline) arm(set func(time.Time) error, now, deadline time.Time, phase Phase) {
+	for {
+		if a.changed.Swap(false) {
+			// The external deadline was set on the connection in place of ours.
+			a.at = a.externalAt()
+		}
+		a.armOnce(set, now, deadline, phase)
+		// Check again in case the external deadline was set while ours was, and ours replaced it.
+		if !a.changed.Load() {
+			return
+		}
+	}
+}
+
+func (a *armedDeadline) armOnce(set func(time.Time) error, now, deadline time.Time, phase Phase) {
+	external := a.externalAt()
+	if !external.IsZero() && (deadline.IsZero() || external.Before(deadline)) {
+		if a.unknown || !a.at.Equal(external) {
+			a.force(set, external)
+		}
+		return
+	}
+	if deadline.IsZero() {
+		if a.unknown || !a.at.IsZero() {
+			a.force(set, time.Time{})
+		}
+		return
+	}
+	slack := deadline.Sub(now) / deadlineSlack
+	if phase != PhaseNone || a.exact {
+		slack = 0
+	}
+	if !a.exact && !a.unknown && !a.at.IsZero() && !a.at.Before(deadline) && a.at.Sub(deadline) <= slack {
+		return
+	}
+	at := deadline.Add(slack)
+	if !external.IsZero() && external.Before(at) {
+		at = external
+	}
+	a.force(set, at)
+}
+
+// done is called after the operation the deadline was armed for. In exact mode it clears the deadline, as every read
+// and write did before deadlines were amortized.
+func (a *armedDeadline) done(set func(time.Time) error) {
+	if a.exact && !a.at.IsZero() {
+		a.force(set, time.Time{})
+	}
+}
+
+// force sets the deadline to at.
+func (a *armedDeadline) force(set func(time.Time) error, at time.Time) {
+	a.at = at
+	a.unknown = set(at) != nil
+}
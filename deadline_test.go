@@ -0,0 +1,227 @@
+package pqtimeouts
+
+import (
+	"database/sql"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+func TestReadDeadlineAmortized(t *testing.T) {
+	testConn := &testNetConn{}
+	conn := &timeoutConn{conn: testConn, readTimeout: time.Minute}
+
+	b := make([]byte, 5)
+	for i := 0; i < 10; i++ {
+		conn.Read(b)
+	}
+	if testConn.setReadDeadlineCalled != 1 {
+		t.Errorf("Expected the deadline to be set once for a run of reads, got %d", testConn.setReadDeadlineCalled)
+	}
+
+	// An earlier deadline set from outside, such as lib/pq's connect_timeout, is kept.
+	early := time.Now().Add(time.Second)
+	conn.SetReadDeadline(early)
+	conn.Read(b)
+	if testConn.setReadDeadlineCalled != 2 || !testConn.setReadDeadlineTime.Equal(early) {
+		t.Errorf("Expected the deadline set from outside to be kept, got %d calls", testConn.setReadDeadlineCalled)
+	}
+
+	// Once it is cleared, the read timeout applies again.
+	conn.SetReadDeadline(time.Time{})
+	conn.Read(b)
+	if testConn.setReadDeadlineCalled != 4 || testConn.setReadDeadlineTime.Before(time.Now().Add(time.Minute/2)) {
+		t.Errorf("Expected the deadline to be set again, got %d calls", testConn.setReadDeadlineCalled)
+	}
+
+	// Turning the timeout off clears the deadline once.
+	conn.readTimeout = 0
+	conn.Read(b)
+	conn.Read(b)
+	if testConn.setReadDeadlineCalled != 5 || !testConn.setReadDeadlineTime.IsZero() {
+		t.Errorf("Expected the deadline to be cleared once, got %d calls", testConn.setReadDeadlineCalled)
+	}
+}
+
+func TestConnectTimeoutKept(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.SetStartup(pqtimeoutstest.Startup{Hang: true})
+
+	// lib/pq sets a deadline for connect_timeout, which must survive reads with no read timeout or a longer one.
+	for _, settings := range []string{"", " read_timeout=5000"} {
+		cfg, err := ParseConfig(srv.ConnString() + " connect_timeout=1" + settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(NewConnector(cfg))
+		done := make(chan error, 1)
+		go func() { done <- db.Ping() }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("Expected Ping to fail with %q", settings)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("connect_timeout was ignored with %q", settings)
+		}
+		db.Close()
+	}
+}
+
+func TestArmedDeadline(t *testing.T) {
+	var set []time.Time
+	setter := func(at time.Time) error {
+		set = append(set, at)
+		return nil
+	}
+	var a armedDeadline
+	now := time.Now()
+
+	a.arm(setter, now, now.Add(16*time.Second), PhaseNone)
+	if len(set) != 1 || !set[0].Equal(now.Add(17*time.Second)) {
+		t.Fatalf("Expected the deadline to be set with slack, got %v", set)
+	}
+	a.arm(setter, now.Add(500*time.Millisecond), now.Add(16500*time.Millisecond), PhaseNone)
+	if len(set) != 1 {
+		t.Error("A deadline within the slack should be kept")
+	}
+	a.arm(setter, now.Add(2*time.Second), now.Add(18*time.Second), PhaseNone)
+	if len(set) != 2 {
+		t.Error("A deadline that is too early should be moved")
+	}
+	a.arm(setter, now, now.Add(10*time.Second), PhaseQuery)
+	if len(set) != 3 || !set[2].Equal(now.Add(10*time.Second)) {
+		t.Errorf("A phase deadline should be set exactly, got %v", set)
+	}
+}
+
+// countingConn counts the deadlines set on a connection.
+type countingConn struct {
+	net.Conn
+	deadlines int
+}
+
+func (c *countingConn) SetReadDeadline(t time.Time) error {
+	c.deadlines++
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *countingConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines++
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// BenchmarkRead reads a stream in small pieces over TCP through a timeoutConn, as lib/pq does for the rows of a chatty
+// query. With every read, the deadline is set before and cleared after each read, as it was before deadlines were
+// amortized. Both report the deadlines set per read.
+func BenchmarkRead(b *testing.B) {
+	for _, every := range []bool{false, true} {
+		name := "amortized"
+		if every {
+			name = "every read"
+		}
+		b.Run(name, func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				server, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				data := make([]byte, 64*1024)
+				for {
+					if _, err := server.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			counting := &countingConn{Conn: client}
+			conn := &timeoutConn{conn: counting, readTimeout: time.Minute}
+			conn.readDeadline.exact = every
+			defer conn.Close()
+
+			buf := make([]byte, 64)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(counting.deadlines)/float64(b.N), "deadlines/op")
+		})
+	}
+}
+
+// writeCounter is a Collector that counts socket writes.
+type writeCounter struct {
+	writes atomic.Int64
+}
+
+func (c *writeCounter) Add(name string, labels Labels, value float64) {}
+
+func (c *writeCounter) Observe(name string, labels Labels, value float64) {
+	if name == MetricWriteDuration {
+		c.writes.Add(1)
+	}
+}
+
+// BenchmarkQuery runs a query returning many small rows through database/sql against a fake server, with and without
+// buffered mode, and reports the socket writes per query.
+func BenchmarkQuery(b *testing.B) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	rows := make([][]string, 100)
+	for i := range rows {
+		rows[i] = []string{"row"}
+	}
+	srv.Handle("SELECT name FROM users WHERE id > $1", pqtimeoutstest.Response{Columns: []string{"name"}, Rows: rows})
+
+	for _, settings := range []string{"", "buffered=true"} {
+		name := "unbuffered"
+		if settings != "" {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg, err := ParseConfig(srv.ConnString() + " read_timeout=5000 write_timeout=5000 " + settings)
+			if err != nil {
+				b.Fatal(err)
+			}
+			counter := &writeCounter{}
+			cfg.Collector = counter
+			db := sql.OpenDB(NewConnector(cfg))
+			defer db.Close()
+			if err := db.Ping(); err != nil {
+				b.Fatal(err)
+			}
+			counter.writes.Store(0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rows, err := db.Query("SELECT name FROM users WHERE id > $1", 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for rows.Next() {
+				}
+				rows.Close()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(counter.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -1,43 +1,201 @@
 package pqtimeouts
 
 import (
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
 	"time"
 )
 
 type timeoutDialer struct {
-	netDial        func(string, string) (net.Conn, error)                // Allow this to be stubbed for testing
-	netDialTimeout func(string, string, time.Duration) (net.Conn, error) // Allow this to be stubbed for testing
-	readTimeout    time.Duration
-	writeTimeout   time.Duration
+	netDial           func(string, string) (net.Conn, error)                // Allow this to be stubbed for testing
+	netDialTimeout    func(string, string, time.Duration) (net.Conn, error) // Allow this to be stubbed for testing
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	applicationName   string
+	collector         Collector
+	logger            eventLogger
+	tracer            Tracer
+	trackProtocol     bool
+	phaseTimeouts     phaseTimeouts
+	slowThreshold     time.Duration
+	redactSlowQueries bool
+	slowQueryHandler  SlowQueryHandler
+	adaptive          *adaptiveTimeouts
+	minThroughput     float64
+	throughputWindow  time.Duration
+	throughputGrace   time.Duration
+	readRateLimit     float64
+	writeRateLimit    float64
+	poolReadLimiter   *RateLimiter
+	poolWriteLimiter  *RateLimiter
+	liveness          *liveness
+	chaos             *Chaos
+	tls               *tlsSettings       // Set when pq-timeouts negotiates TLS in place of lib/pq
+	sqlHints          string             // Apply timeout hints in SQL comments when set
+	live              *liveTimeouts      // The timeouts of the Connector, which can change, when set
+	hosts             *hostTable         // Overrides the timeouts of some hosts when set
+	bufferSize        int                // Buffer connections when set
+	ctx               context.Context    // The context of the Connect call that created the dialer
+	onDial            func(*timeoutConn) // Called with each connection wrapped
 }
 
 func (t timeoutDialer) Dial(network string, address string) (net.Conn, error) {
-	// If we don't have any timeouts set, just return a normal connection
-	if t.readTimeout == 0 && t.writeTimeout == 0 {
-		return t.netDial(network, address)
+	if timeout := t.hosts.dialTimeout(address, 0); timeout != 0 {
+		return t.DialTimeout(network, address, timeout)
 	}
+	start := time.Now()
+	t.logger.log(slog.LevelDebug, "pqtimeouts: dialing", "network", network, "address", address)
+	c, err := t.traceDial(address, func() (net.Conn, error) { return t.netDial(network, address) })
+	return t.wrap(c, err, network, address, start)
+}
 
-	// Otherwise we want a timeoutConn to handle the read and write deadlines for us.
-	c, err := t.netDial(network, address)
-	if err != nil || c == nil {
-		return c, err
-	}
+func (t timeoutDialer) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+	start := time.Now()
+	timeout = t.hosts.dialTimeout(address, timeout)
+	t.logger.log(slog.LevelDebug, "pqtimeouts: dialing", "network", network, "address", address, "timeout", timeout)
+	c, err := t.traceDial(address, func() (net.Conn, error) { return t.netDialTimeout(network, address, timeout) })
+	return t.wrap(c, err, network, address, start)
+}
 
-	return &timeoutConn{conn: c, readTimeout: t.readTimeout, writeTimeout: t.writeTimeout}, nil
+// traceDial calls dial, inside a dial span if there is a tracer.
+func (t timeoutDialer) traceDial(address string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if t.tracer == nil {
+		return dial()
+	}
+	return traceDial(t.context(), t.tracer, address, dial)
 }
 
-func (t timeoutDialer) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
-	// If we don't have any timeouts set, just return a normal connection
-	if t.readTimeout == 0 && t.writeTimeout == 0 {
-		return t.netDialTimeout(network, address, timeout)
+func (t timeoutDialer) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
 	}
+	return t.ctx
+}
 
-	// Otherwise we want a timeoutConn to handle the read and write deadlines for us.
-	c, err := t.netDialTimeout(network, address, timeout)
+// wrap returns the result of a dial, wrapped in a timeoutConn when there is something for it to do.
+func (t timeoutDialer) wrap(c net.Conn, err error, network, address string, start time.Time) (net.Conn, error) {
+	labels := Labels{Host: hostOf(address), ApplicationName: t.applicationName}
+	if err != nil {
+		if t.collector != nil {
+			t.collector.Add(MetricDialErrors, labels, 1)
+		}
+		t.logger.log(slog.LevelError, "pqtimeouts: dial failed",
+			"address", address, "elapsed", time.Since(start), "error", err)
+	}
 	if err != nil || c == nil {
 		return c, err
 	}
+	t.logger.log(slog.LevelDebug, "pqtimeouts: connected", "address", address, "elapsed", time.Since(start))
+	if t.chaos != nil {
+		c = t.chaos.Conn(c)
+	}
+	if t.tls != nil {
+		upgraded, err := t.startTLS(c, address)
+		if err != nil {
+			c.Close()
+			if t.collector != nil {
+				t.collector.Add(MetricDialErrors, labels, 1)
+			}
+			return nil, err
+		}
+		c = upgraded
+	}
 
-	return &timeoutConn{conn: c, readTimeout: t.readTimeout, writeTimeout: t.writeTimeout}, nil
+	// If we don't have any timeouts set or anything to report, just return a normal connection. Connections opened by
+	// a Connector are always wrapped, so the context of a query can give them timeouts.
+	if t.readTimeout == 0 && t.writeTimeout == 0 && t.collector == nil && t.logger.logger == nil && t.tracer == nil &&
+		!t.tracksProtocol() && t.adaptive == nil && !t.limitsRate() && t.liveness == nil &&
+		t.tls == nil && t.sqlHints == "" && t.hosts == nil && t.bufferSize == 0 &&
+		t.onDial == nil {
+		return c, nil
+	}
+
+	// Otherwise we want a timeoutConn to handle the read and write deadlines for us.
+	if t.collector != nil {
+		t.collector.Add(MetricConnectionsOpened, labels, 1)
+	}
+	tc := &timeoutConn{
+		conn:         c,
+		readTimeout:  t.readTimeout,
+		writeTimeout: t.writeTimeout,
+		collector:    t.collector,
+		logger:       t.logger,
+		labels:       labels,
+		network:      network,
+		address:      address,
+		opened:       time.Now()}
+	tc.setContext(t.context())
+	if t.adaptive != nil {
+		tc.adaptive = t.adaptive.host(labels.Host)
+	}
+	tc.live = t.live
+	tc.host = t.hosts.match(labels.Host, remoteIP(c))
+	if t.bufferSize > 0 {
+		tc.readBuffer = &readBuffer{buf: make([]byte, t.bufferSize)}
+		tc.writeBuffer = &writeBuffer{buf: make([]byte, 0, t.bufferSize), size: t.bufferSize}
+	}
+	if t.sqlHints != "" {
+		tc.hints = newHintTracker(t.sqlHints, t.logger)
+	}
+	tc.liveness = t.liveness
+	tc.tlsConn, _ = c.(*tls.Conn)
+	tc.readLimiters = connLimiters(t.readRateLimit, t.poolReadLimiter)
+	tc.writeLimiters = connLimiters(t.writeRateLimit, t.poolWriteLimiter)
+	if t.tracksProtocol() || (tc.host != nil && tc.host.IdleInTransaction != 0) {
+		tc.protocol = newProtocolTracker()
+		tc.phaseTimeouts = t.phaseTimeouts
+	}
+	if t.minThroughput > 0 {
+		tc.throughput = newThroughputMonitor(t.minThroughput, t.throughputWindow, t.throughputGrace)
+	}
+	if t.slowThreshold != 0 {
+		slow := &slowQueries{
+			threshold: t.slowThreshold,
+			redact:    t.redactSlowQueries,
+			handler:   t.slowQueryHandler,
+			logger:    t.logger,
+			host:      labels.Host}
+		tc.protocol.queryDone = slow.queryDone
+	}
+	if t.tracer != nil {
+		tc.trace = &connTrace{tracer: t.tracer, address: address}
+	}
+	if t.onDial != nil {
+		t.onDial(tc)
+	}
+	return tc, nil
+}
+
+// tracksProtocol reports whether connections need a protocolTracker.
+func (t timeoutDialer) tracksProtocol() bool {
+	return t.trackProtocol || t.tracer != nil || t.phaseTimeouts.any() || t.slowThreshold != 0 ||
+		t.minThroughput > 0
+}
+
+func (t timeoutDialer) limitsRate() bool {
+	return t.readRateLimit > 0 || t.writeRateLimit > 0 || t.poolReadLimiter != nil || t.poolWriteLimiter != nil
+}
+
+// connLimiters returns the limiters for one direction of a new connection.
+func connLimiters(rate float64, pool *RateLimiter) rateLimiters {
+	var limiters rateLimiters
+	if rate > 0 {
+		limiters = append(limiters, NewRateLimiter(rate, 0))
+	}
+	if pool != nil {
+		limiters = append(limiters, pool)
+	}
+	return limiters
+}
+
+// hostOf returns the host part of a dialed address. Addresses without a port, such as unix socket paths, are returned
+// unchanged.
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
 }
@@ -0,0 +1,198 @@
+package pqtimeouts
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+// driverConn wraps a lib/pq connection so the context of each operation reaches the timeoutConn underneath it. The
+// context stays in place until the next operation, so it also covers reading the rows of a query.
+type driverConn struct {
+	driver.Conn
+	tc *timeoutConn
+}
+
+func (c *driverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.tc.setContext(ctx)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	return rows, c.tc.driverError(err)
+}
+
+func (c *driverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.tc.setContext(ctx)
+	result, err := execer.ExecContext(ctx, query, args)
+	return result, c.tc.driverError(err)
+}
+
+func (c *driverConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	c.tc.setContext(ctx)
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, c.tc.driverError(err)
+	}
+	return &driverStmt{Stmt: stmt, tc: c.tc}, nil
+}
+
+// driverStmt wraps a prepared statement so the context of each execution reaches the timeoutConn, as driverConn does
+// for queries.
+type driverStmt struct {
+	driver.Stmt
+	tc *timeoutConn
+}
+
+func (s *driverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	s.tc.setContext(ctx)
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = driverValues(args); err != nil {
+			return nil, err
+		}
+		rows, err = s.Stmt.Query(values)
+	}
+	return rows, s.tc.driverError(err)
+}
+
+func (s *driverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (result driver.Result, err error) {
+	s.tc.setContext(ctx)
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = driverValues(args); err != nil {
+			return nil, err
+		}
+		result, err = s.Stmt.Exec(values)
+	}
+	return result, s.tc.driverError(err)
+}
+
+// driverValues converts args for a statement that only takes positional values, as database/sql does.
+func driverValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("pqtimeouts: lib/pq does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+func (c *driverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.Tx, err error) {
+	c.tc.setContext(ctx)
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, c.tc.driverError(err)
+	}
+	// The transaction ends with its own timeouts, not those of its last statement. Cancelling the context rolls the
+	// transaction back, which mustn't be cut short by the cancellation.
+	return &driverTx{Tx: tx, ctx: context.WithoutCancel(ctx), tc: c.tc}, nil
+}
+
+// driverTx wraps a transaction so the context it was begun with reaches the timeoutConn for Commit and Rollback.
+type driverTx struct {
+	driver.Tx
+	ctx context.Context
+	tc  *timeoutConn
+}
+
+func (t *driverTx) Commit() error {
+	t.tc.setContext(t.ctx)
+	return t.tc.driverError(t.Tx.Commit())
+}
+
+func (t *driverTx) Rollback() error {
+	t.tc.setContext(t.ctx)
+	return t.tc.driverError(t.Tx.Rollback())
+}
+
+func (c *driverConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		c.tc.setContext(ctx)
+		return c.tc.driverError(pinger.Ping(ctx))
+	}
+	return nil
+}
+
+func (c *driverConn) ResetSession(ctx context.Context) error {
+	c.tc.setContext(nil)
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *driverConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *driverConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// State returns the protocol state of the connection. It can be reached through sql.Conn.Raw:
+//
+//	conn.Raw(func(driverConn any) error {
+//		state := driverConn.(interface{ State() pqtimeouts.ConnState }).State()
+//		...
+//	})
+func (c *driverConn) State() ConnState {
+	return c.tc.State()
+}
+
+// TLSConnectionState returns the negotiated TLS version, cipher suite and certificates when pq-timeouts negotiated
+// TLS itself. It can be reached through sql.Conn.Raw in the same way as State.
+func (c *driverConn) TLSConnectionState() (tls.ConnectionState, bool) {
+	return c.tc.TLSConnectionState()
+}
+
+// dialCapture records the timeoutConn dialed while a connection is being opened. lib/pq keeps the dialer to send
+// cancel requests, so dials after the connection is open are ignored.
+type dialCapture struct {
+	mu   sync.Mutex
+	conn *timeoutConn
+	done bool
+}
+
+func (d *dialCapture) dialed(tc *timeoutConn) {
+	d.mu.Lock()
+	if !d.done {
+		d.conn = tc
+	}
+	d.mu.Unlock()
+}
+
+// finish stops recording dials and returns the connection dialed, if any.
+func (d *dialCapture) finish() *timeoutConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done = true
+	return d.conn
+}
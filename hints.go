@@ -0,0 +1,178 @@
+package pqtimeouts
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for timeout hints in SQL comments, set by sql_hints.
+const (
+	SQLHintsKeep  = "keep"  // Apply hints and send them to the server
+	SQLHintsStrip = "strip" // Apply hints and remove them from the SQL sent to the server
+)
+
+// hintPrefix starts a timeout hint, which must be the first thing in a statement:
+//
+//	/*+ pqtimeouts read_timeout=10s write_timeout=500ms */ SELECT ...
+const hintPrefix = "/*+ pqtimeouts "
+
+// hintTracker applies timeout hints found in the queries written to a connection. A hint in a Query message applies
+// until the next query. A hint in a Parse message applies whenever its prepared statement is bound. It is locked, as
+// reads look up the current hint while lib/pq may be writing from another goroutine during COPY.
+type hintTracker struct {
+	mu         sync.Mutex
+	strip      bool
+	logger     eventLogger
+	current    timeoutOverride            // The hint of the statement in progress
+	statements map[string]timeoutOverride // The hints of prepared statements by name
+}
+
+func newHintTracker(mode string, logger eventLogger) *hintTracker {
+	return &hintTracker{strip: mode == SQLHintsStrip, logger: logger}
+}
+
+// rewrite applies the hints in the messages in b, which lib/pq always writes whole, and returns b with the hints
+// removed if they are stripped. Anything that isn't a sequence of whole messages, such as the startup message or TLS
+// records, is returned unchanged.
+func (h *hintTracker) rewrite(b []byte) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []byte
+	for rest := b; len(rest) > 0; {
+		if len(rest) < 5 || !isMessageType(rest[0]) {
+			return b
+		}
+		length := int(binary.BigEndian.Uint32(rest[1:5]))
+		if length < 4 || length+1 > len(rest) {
+			return b
+		}
+		message := rest[:length+1]
+		rest = rest[length+1:]
+		if rewritten := h.message(message); rewritten != nil && out == nil {
+			// Copy the messages before this one, which were unchanged.
+			out = append(make([]byte, 0, len(b)), b[:len(b)-len(rest)-len(message)]...)
+			out = append(out, rewritten...)
+		} else if rewritten != nil {
+			out = append(out, rewritten...)
+		} else if out != nil {
+			out = append(out, message...)
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
+
+// hint returns the hint of the statement in progress.
+func (h *hintTracker) hint() timeoutOverride {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// message applies the hint in a whole message, returning the message without it when the hint is stripped, or nil if
+// it is unchanged.
+func (h *hintTracker) message(message []byte) []byte {
+	body := message[5:]
+	switch message[0] {
+	case 'Q':
+		query, _ := cString(body)
+		var stripped string
+		h.current, stripped = h.parse(query)
+		if stripped == query {
+			return nil
+		}
+		return h.build('Q', []byte(stripped), []byte{0})
+	case 'P':
+		name, rest := cString(body)
+		query, params := cString(rest)
+		hint, stripped := h.parse(query)
+		h.current = hint
+		if hint == (timeoutOverride{}) {
+			delete(h.statements, name)
+		} else if _, ok := h.statements[name]; ok || len(h.statements) < maxStatements {
+			if h.statements == nil {
+				h.statements = make(map[string]timeoutOverride)
+			}
+			h.statements[name] = hint
+		}
+		if stripped == query {
+			return nil
+		}
+		return h.build('P', []byte(name), []byte{0}, []byte(stripped), []byte{0}, params)
+	case 'B':
+		// Bind names the portal and then the prepared statement.
+		_, rest := cString(body)
+		name, _ := cString(rest)
+		h.current = h.statements[name]
+	case 'C':
+		if len(body) > 0 && body[0] == 'S' {
+			name, _ := cString(body[1:])
+			delete(h.statements, name)
+		}
+	}
+	return nil
+}
+
+// build returns a message of type typ with a body made of parts.
+func (h *hintTracker) build(typ byte, parts ...[]byte) []byte {
+	length := 4
+	for _, part := range parts {
+		length += len(part)
+	}
+	message := make([]byte, 5, length+1)
+	message[0] = typ
+	binary.BigEndian.PutUint32(message[1:], uint32(length))
+	for _, part := range parts {
+		message = append(message, part...)
+	}
+	return message
+}
+
+// parse returns the timeouts given by the hint at the start of query, and the query to send: without the hint if
+// hints are stripped. Malformed settings in a hint are logged and ignored.
+func (h *hintTracker) parse(query string) (hint timeoutOverride, rest string) {
+	trimmed := strings.TrimLeft(query, " \t\r\n")
+	if !strings.HasPrefix(trimmed, hintPrefix) {
+		return hint, query
+	}
+	end := strings.Index(trimmed, "*/")
+	if end < 0 {
+		return hint, query
+	}
+
+	for _, setting := range strings.Fields(trimmed[len(hintPrefix):end]) {
+		key, value, _ := strings.Cut(setting, "=")
+		d, ok := parseHintDuration(value)
+		switch {
+		case ok && key == "read_timeout":
+			hint.read, hint.hasRead = d, true
+		case ok && key == "write_timeout":
+			hint.write, hint.hasWrite = d, true
+		default:
+			h.logger.log(slog.LevelWarn, "pqtimeouts: ignoring invalid timeout hint", "setting", setting)
+		}
+	}
+	if h.strip {
+		return hint, strings.TrimLeft(trimmed[end+2:], " \t\r\n")
+	}
+	return hint, query
+}
+
+// parseHintDuration parses a duration such as 10s, or a number of milliseconds as in connection strings.
+func parseHintDuration(v string) (time.Duration, bool) {
+	if ms, err := strconv.Atoi(v); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil && d >= 0
+}
+
+func isMessageType(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
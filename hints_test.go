@@ -0,0 +1,88 @@
+package pqtimeouts
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+func TestParseHint(t *testing.T) {
+	h := newHintTracker(SQLHintsStrip, eventLogger{})
+	hint, rest := h.parse(" /*+ pqtimeouts read_timeout=10s write_timeout=500 bogus=1 */\n SELECT 1")
+	if !hint.hasRead || hint.read != 10*time.Second || !hint.hasWrite || hint.write != 500*time.Millisecond {
+		t.Errorf("The hint was not as expected: %+v", hint)
+	}
+	if rest != "SELECT 1" {
+		t.Errorf("The hint was not stripped: %q", rest)
+	}
+
+	h = newHintTracker(SQLHintsKeep, eventLogger{})
+	query := "/*+ pqtimeouts read_timeout=10s */ SELECT 1"
+	if hint, rest := h.parse(query); !hint.hasRead || rest != query {
+		t.Errorf("The hint should be kept, got %+v %q", hint, rest)
+	}
+	for _, query := range []string{"SELECT 1", "SELECT /*+ pqtimeouts read_timeout=1s */ 1", "/* read_timeout=1s */"} {
+		if hint, rest := h.parse(query); hint != (timeoutOverride{}) || rest != query {
+			t.Errorf("Expected no hint in %q, got %+v", query, hint)
+		}
+	}
+}
+
+func TestHintRewrite(t *testing.T) {
+	h := newHintTracker(SQLHintsStrip, eventLogger{})
+	parse := h.build('P', []byte("stmt1\x00/*+ pqtimeouts read_timeout=2s */ SELECT $1\x00"), []byte{0, 0})
+	sync := []byte{'S', 0, 0, 0, 4}
+	b := append(append([]byte{}, parse...), sync...)
+
+	rewritten := h.rewrite(b)
+	expected := append(h.build('P', []byte("stmt1\x00SELECT $1\x00"), []byte{0, 0}), sync...)
+	if !bytes.Equal(rewritten, expected) {
+		t.Errorf("The messages were not rewritten as expected: %q", rewritten)
+	}
+	if h.current.read != 2*time.Second {
+		t.Error("The hint should apply while the statement is prepared")
+	}
+
+	h.rewrite(h.build('Q', []byte("SELECT 2\x00")))
+	if h.current.hasRead {
+		t.Error("The hint should not apply to the next query")
+	}
+	h.rewrite(h.build('B', []byte("\x00stmt1\x00"), []byte{0, 0, 0, 0, 0, 0}))
+	if h.current.read != 2*time.Second {
+		t.Error("The hint should apply when the statement is bound")
+	}
+
+	startup := []byte{0, 0, 0, 8, 4, 210, 22, 47}
+	if rewritten := h.rewrite(startup); !bytes.Equal(rewritten, startup) {
+		t.Error("Untyped messages should be left alone")
+	}
+}
+
+func TestSQLHints(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT report()", pqtimeoutstest.Response{Columns: []string{"report"}, Rows: [][]string{{"ok"}},
+		Delay: 200 * time.Millisecond})
+
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=50 sql_hints=strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var report string
+	if err := db.QueryRow("/*+ pqtimeouts read_timeout=1s */ SELECT report()").Scan(&report); err != nil {
+		t.Errorf("Expected the hinted read timeout to be used, got %v", err)
+	}
+	if err := db.QueryRow("SELECT report()").Scan(&report); !isTimeout(err) {
+		t.Errorf("Expected the read timeout of the connection without a hint, got %v", err)
+	}
+	for _, query := range srv.Queries() {
+		if query != "SELECT report()" {
+			t.Errorf("The hint was not stripped: %q", query)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package pqtimeouts
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// HostTimeouts overrides the timeouts of connections to some hosts, such as replicas in another region.
+type HostTimeouts struct {
+	Host     string        // A host name or IP address as dialed, or a CIDR block containing the address connected to
+	Timeouts               // Zero fields keep the timeouts of the Connector
+	Connect  time.Duration // Bounds the dial in place of connect_timeout when set, for hosts matched by name or IP
+}
+
+// apply returns timeouts with the non-zero fields of h in place of its own.
+func (h *HostTimeouts) apply(timeouts Timeouts) Timeouts {
+	if h == nil {
+		return timeouts
+	}
+	if h.Read != 0 {
+		timeouts.Read = h.Read
+	}
+	if h.Write != 0 {
+		timeouts.Write = h.Write
+	}
+	if h.IdleInTransaction != 0 {
+		timeouts.IdleInTransaction = h.IdleInTransaction
+	}
+	return timeouts
+}
+
+// hostTable finds the HostTimeouts for a dialed address.
+type hostTable struct {
+	entries []HostTimeouts
+	blocks  []*net.IPNet // The CIDR block of each entry, or nil
+}
+
+// newHostTable returns a table of a copy of entries, so the caller changing them later has no effect, or nil if there
+// are none.
+func newHostTable(entries []HostTimeouts) (*hostTable, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	h := &hostTable{entries: append([]HostTimeouts(nil), entries...), blocks: make([]*net.IPNet, len(entries))}
+	for i, entry := range entries {
+		if strings.Contains(entry.Host, "/") {
+			_, block, err := net.ParseCIDR(entry.Host)
+			if err != nil {
+				return nil, fmt.Errorf("pqtimeouts: invalid CIDR block %q in host timeouts", entry.Host)
+			}
+			h.blocks[i] = block
+		}
+	}
+	return h, nil
+}
+
+// match returns the first entry for host, a name or IP address, or for ip, the address connected to, if it is known.
+func (h *hostTable) match(host string, ip net.IP) *HostTimeouts {
+	if h == nil {
+		return nil
+	}
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	for i := range h.entries {
+		if block := h.blocks[i]; block != nil {
+			if ip != nil && block.Contains(ip) {
+				return &h.entries[i]
+			}
+		} else if strings.EqualFold(h.entries[i].Host, host) {
+			return &h.entries[i]
+		}
+	}
+	return nil
+}
+
+// dialTimeout returns the timeout for dialing address, which is timeout unless the host has its own.
+func (h *hostTable) dialTimeout(address string, timeout time.Duration) time.Duration {
+	if match := h.match(hostOf(address), nil); match != nil && match.Connect != 0 {
+		return match.Connect
+	}
+	return timeout
+}
+
+// remoteIP returns the IP address c is connected to, if it has one.
+func remoteIP(c net.Conn) net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
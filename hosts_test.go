@@ -0,0 +1,127 @@
+package pqtimeouts
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostTableMatch(t *testing.T) {
+	hosts, err := newHostTable([]HostTimeouts{
+		{Host: "replica.eu.example.com", Timeouts: Timeouts{Read: 2 * time.Second}},
+		{Host: "10.1.0.0/16", Timeouts: Timeouts{Read: 3 * time.Second}},
+		{Host: "10.2.0.5", Timeouts: Timeouts{Read: 4 * time.Second}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		host     string
+		ip       net.IP
+		expected time.Duration
+	}{
+		{"Replica.EU.example.com", nil, 2 * time.Second},
+		{"replica.us.example.com", net.ParseIP("10.1.4.2"), 3 * time.Second},
+		{"10.1.4.2", nil, 3 * time.Second},
+		{"10.2.0.5", nil, 4 * time.Second},
+		{"primary.example.com", net.ParseIP("10.3.0.1"), 0},
+	} {
+		match := hosts.match(test.host, test.ip)
+		if read := match.apply(Timeouts{}).Read; read != test.expected {
+			t.Errorf("The read timeout for %s (%v) was not as expected: %v", test.host, test.ip, read)
+		}
+	}
+
+	if _, err := newHostTable([]HostTimeouts{{Host: "10.1.0.0/99"}}); err == nil {
+		t.Error("Expected an error for an invalid CIDR block")
+	}
+
+	entries := []HostTimeouts{{Host: "10.1.0.0/16", Timeouts: Timeouts{Read: 3 * time.Second}}}
+	if hosts, err = newHostTable(entries); err != nil {
+		t.Fatal(err)
+	}
+	entries[0] = HostTimeouts{Host: "10.2.0.5", Timeouts: Timeouts{Read: 4 * time.Second}}
+	if read := hosts.match("10.1.4.2", nil).apply(Timeouts{}).Read; read != 3*time.Second {
+		t.Errorf("Changing the entries after the table was made should not change it, got %v", read)
+	}
+}
+
+func TestHostTimeoutsApply(t *testing.T) {
+	h := &HostTimeouts{Timeouts: Timeouts{Read: 5 * time.Second}}
+	timeouts := h.apply(Timeouts{Read: time.Second, Write: time.Second})
+	if timeouts != (Timeouts{Read: 5 * time.Second, Write: time.Second}) {
+		t.Errorf("Zero fields should keep their value: %+v", timeouts)
+	}
+}
+
+func TestDialHostTimeouts(t *testing.T) {
+	hosts, _ := newHostTable([]HostTimeouts{
+		{Host: "replica", Timeouts: Timeouts{Read: 5 * time.Second}, Connect: 10 * time.Second},
+		{Host: "192.168.0.0/24", Timeouts: Timeouts{Write: 3 * time.Second}}})
+	var dialTimeout time.Duration
+	testConn := &testNetConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.7"), Port: 5432}}
+	dialer := timeoutDialer{
+		netDial: func(network, address string) (net.Conn, error) { return testConn, nil },
+		netDialTimeout: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			dialTimeout = timeout
+			return testConn, nil
+		},
+		readTimeout:  time.Second,
+		writeTimeout: time.Second,
+		hosts:        hosts}
+
+	conn, err := dialer.Dial("tcp", "replica:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialTimeout != 10*time.Second {
+		t.Errorf("The dial timeout was not as expected: %v", dialTimeout)
+	}
+	if timeouts := conn.(*timeoutConn).currentTimeouts(); timeouts.Read != 5*time.Second || timeouts.Write != time.Second {
+		t.Errorf("The timeouts were not as expected: %+v", timeouts)
+	}
+
+	conn, err = dialer.DialTimeout("tcp", "db.example.com:5432", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialTimeout != 2*time.Second {
+		t.Errorf("The dial timeout was not as expected: %v", dialTimeout)
+	}
+	if timeouts := conn.(*timeoutConn).currentTimeouts(); timeouts.Read != time.Second || timeouts.Write != 3*time.Second {
+		t.Errorf("The CIDR block should match the address connected to: %+v", timeouts)
+	}
+}
+
+func TestHostTimeoutsCapAdaptive(t *testing.T) {
+	connector := NewConnector(Config{ReadTimeout: 5 * time.Second, AdaptiveReadTimeout: true,
+		HostTimeouts: []HostTimeouts{{Host: "replica", Timeouts: Timeouts{Read: time.Second}}}})
+	dialer := connector.dialer()
+	dialer.netDial = func(network string, address string) (net.Conn, error) {
+		return &testNetConn{}, nil
+	}
+
+	replica, _ := dialer.Dial("tcp", "replica:5432")
+	if timeout := replica.(*timeoutConn).currentReadTimeout(); timeout != time.Second {
+		t.Errorf("The host's read timeout should cap its adaptive timeout: %v", timeout)
+	}
+	primary, _ := dialer.Dial("tcp", "primary:5432")
+	if timeout := primary.(*timeoutConn).currentReadTimeout(); timeout != 5*time.Second {
+		t.Errorf("Other hosts should keep the adaptive timeout: %v", timeout)
+	}
+
+	for i := 0; i < adaptiveMinSamples; i++ {
+		connector.adaptive.host("replica").observe(time.Millisecond)
+	}
+	if timeout := replica.(*timeoutConn).currentReadTimeout(); timeout != DefaultAdaptiveMinReadTimeout {
+		t.Errorf("A shorter learned timeout should be used for the host: %v", timeout)
+	}
+}
+
+func TestConnectorInvalidHostTimeouts(t *testing.T) {
+	connector := NewConnector(Config{ConnString: "dbname=pqtest", HostTimeouts: []HostTimeouts{{Host: "10.0.0.0/33"}}})
+	if _, err := connector.Connect(context.Background()); err == nil {
+		t.Error("Expected an error for an invalid CIDR block")
+	}
+}
@@ -0,0 +1,76 @@
+package pqtimeouts
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Bits of connLifecycle.state above the count of operations in progress.
+const (
+	lifecycleClosed   int64 = 1 << 62
+	lifecycleFinished int64 = 1 << 61
+	lifecycleCount    int64 = lifecycleFinished - 1
+)
+
+// connLifecycle lets a timeoutConn be closed from one goroutine while another is reading or writing. Closing the
+// underlying connection unblocks any operation in progress, and the bookkeeping for the close, which shares state with
+// reads and writes, runs once the last of them has returned.
+type connLifecycle struct {
+	closeMu sync.Mutex   // Serializes Close
+	state   atomic.Int64 // lifecycleClosed and lifecycleFinished, and the number of operations in progress
+}
+
+// begin starts an operation, returning false if the connection is closed.
+func (l *connLifecycle) begin() bool {
+	for {
+		state := l.state.Load()
+		if state&lifecycleClosed != 0 {
+			return false
+		}
+		if l.state.CompareAndSwap(state, state+1) {
+			return true
+		}
+	}
+}
+
+// end finishes an operation, calling finish if it was the last one in progress on a closed connection.
+func (l *connLifecycle) end(finish func()) {
+	if state := l.state.Add(-1); state&lifecycleClosed != 0 && state&lifecycleCount == 0 {
+		l.finish(finish)
+	}
+}
+
+// close marks the connection closed once closeConn succeeds, and calls finish unless an operation is still in
+// progress. It returns false if the connection was already closed.
+func (l *connLifecycle) close(closeConn func() error, finish func()) (bool, error) {
+	l.closeMu.Lock()
+	defer l.closeMu.Unlock()
+	if l.state.Load()&lifecycleClosed != 0 {
+		return false, nil
+	}
+	if err := closeConn(); err != nil {
+		return true, err
+	}
+	if state := l.state.Or(lifecycleClosed) | lifecycleClosed; state&lifecycleCount == 0 {
+		l.finish(finish)
+	}
+	return true, nil
+}
+
+// finish calls finish unless it has already been called.
+func (l *connLifecycle) finish(finish func()) {
+	for {
+		state := l.state.Load()
+		if state&lifecycleFinished != 0 {
+			return
+		}
+		if l.state.CompareAndSwap(state, state|lifecycleFinished) {
+			finish()
+			return
+		}
+	}
+}
+
+func (l *connLifecycle) closed() bool {
+	return l.state.Load()&lifecycleClosed != 0
+}
@@ -0,0 +1,163 @@
+package pqtimeouts
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnLifecycle(t *testing.T) {
+	var l connLifecycle
+	finished := 0
+	finish := func() { finished++ }
+	closeConn := func() error { return nil }
+
+	if !l.begin() {
+		t.Fatal("An open connection should allow operations")
+	}
+	if ok, err := l.close(closeConn, finish); !ok || err != nil {
+		t.Fatalf("Unexpected close result: %v, %v", ok, err)
+	}
+	if finished != 0 {
+		t.Error("The close should not finish while an operation is in progress")
+	}
+	if l.begin() {
+		t.Error("A closed connection should not allow operations")
+	}
+	l.end(finish)
+	if finished != 1 {
+		t.Errorf("The close should finish with the last operation, finished %d times", finished)
+	}
+	if ok, _ := l.close(closeConn, finish); ok || finished != 1 {
+		t.Error("Closing again should do nothing")
+	}
+}
+
+// newPipeConn returns a timeoutConn over one end of a pipe, and the other end.
+func newPipeConn(registry *Registry) (*timeoutConn, net.Conn) {
+	client, server := net.Pipe()
+	conn := &timeoutConn{
+		conn:         client,
+		readTimeout:  time.Minute,
+		writeTimeout: time.Minute,
+		collector:    registry,
+		labels:       Labels{Host: "db1"},
+		protocol:     newProtocolTracker(),
+		opened:       time.Now()}
+	return conn, server
+}
+
+func TestCloseDuringRead(t *testing.T) {
+	registry := NewRegistry()
+	conn, server := newPipeConn(registry)
+	defer server.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("The read should fail when the connection is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt the read")
+	}
+	if registry.Counter(MetricConnectionsClosed, Labels{Host: "db1"}) != 1 {
+		t.Error("The close should be counted once")
+	}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("Reading a closed connection should fail")
+	}
+}
+
+func TestConcurrentCloseAndIO(t *testing.T) {
+	registry := NewRegistry()
+	conn, server := newPipeConn(registry)
+	go func() {
+		// Echo whatever is written until the connection closes.
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				server.Close()
+				return
+			}
+			server.Write(buf[:n])
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var closed atomic.Int32
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			conn.SetDeadline(time.Now().Add(time.Minute))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(5 * time.Millisecond)
+		var closers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				if conn.Close() == nil {
+					closed.Add(1)
+				}
+			}()
+		}
+		closers.Wait()
+	}()
+	wg.Wait()
+
+	if closed.Load() != 1 {
+		t.Errorf("Exactly one Close should succeed, %d did", closed.Load())
+	}
+	if registry.Counter(MetricConnectionsClosed, Labels{Host: "db1"}) != 1 {
+		t.Error("The close should be counted once")
+	}
+}
+
+// TestConcurrentCopyIn runs COPY FROM STDIN with every feature that keeps per-connection state on. lib/pq reads the
+// connection from another goroutine while it writes the rows, so run it with -race.
+func TestConcurrentCopyIn(t *testing.T) {
+	testCopyIn(t, "read_timeout=5000 write_timeout=5000 query_timeout=5000 copy_timeout=5000 "+
+		"idle_in_transaction_timeout=5000 buffered=true sql_hints=keep slow_threshold=1 adaptive_read_timeout=true "+
+		"min_throughput=1 read_rate_limit=100000000 write_rate_limit=100000000",
+		func(cfg *Config) {
+			cfg.Collector = NewRegistry()
+			cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			cfg.Tracer = &testTracer{}
+		})
+}
@@ -0,0 +1,144 @@
+package pqtimeouts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts are the timeouts of a Connector that can be changed while it is in use.
+type Timeouts struct {
+	Read              time.Duration
+	Write             time.Duration
+	IdleInTransaction time.Duration // Only enforced on connections that track the protocol
+}
+
+// liveTimeouts holds the Timeouts shared by a Connector and its connections.
+type liveTimeouts struct {
+	current atomic.Pointer[Timeouts]
+}
+
+func newLiveTimeouts(t Timeouts) *liveTimeouts {
+	l := &liveTimeouts{}
+	l.current.Store(&t)
+	return l
+}
+
+func (l *liveTimeouts) load() Timeouts {
+	return *l.current.Load()
+}
+
+// Timeouts returns the timeouts currently used by the Connector.
+func (c *Connector) Timeouts() Timeouts {
+	return c.timeouts.load()
+}
+
+// SetTimeouts changes the read, write and idle in transaction timeouts of new and existing connections together. A
+// change applies to the next read or write of each connection, not one already waiting. Idle in transaction timeouts
+// only apply to connections tracking the protocol, which those opened without any phase timeouts don't.
+func (c *Connector) SetTimeouts(t Timeouts) {
+	c.timeouts.current.Store(&t)
+	c.logger().log(slog.LevelInfo, "pqtimeouts: timeouts changed", "read_timeout", t.Read,
+		"write_timeout", t.Write, "idle_in_transaction_timeout", t.IdleInTransaction)
+}
+
+// LoadTimeouts reads timeouts from a file holding read_timeout, write_timeout and idle_in_transaction_timeout settings
+// in milliseconds, in the form of a connection string. Settings missing from the file keep their value in current.
+func LoadTimeouts(path string, current Timeouts) (Timeouts, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Timeouts{}, err
+	}
+	for _, setting := range strings.Fields(string(contents)) {
+		s := strings.Split(setting, "=")
+		switch s[0] {
+		case "read_timeout":
+			current.Read, err = parseMilliseconds(s)
+		case "write_timeout":
+			current.Write, err = parseMilliseconds(s)
+		case "idle_in_transaction_timeout":
+			current.IdleInTransaction, err = parseMilliseconds(s)
+		default:
+			err = fmt.Errorf("Unknown setting %s in %s", s[0], path)
+		}
+		if err != nil {
+			return Timeouts{}, err
+		}
+	}
+	return current, nil
+}
+
+// ReloadTimeouts loads the timeouts of the Connector from a file, as LoadTimeouts does, and then keeps loading them in
+// the background until ctx is done: whenever one of signals is received, and when the file changes if interval isn't
+// 0. It returns an error if the first load fails. Later failures are logged and the timeouts are left unchanged.
+//
+//	err := connector.ReloadTimeouts(ctx, "/etc/app/pq-timeouts", 10*time.Second, syscall.SIGHUP)
+func (c *Connector) ReloadTimeouts(ctx context.Context, path string, interval time.Duration, signals ...os.Signal) error {
+	modTime, err := c.reloadTimeouts(path)
+	if err != nil {
+		return err
+	}
+
+	received := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(received, signals...)
+	}
+	go func() {
+		defer signal.Stop(received)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-received:
+			case <-tick:
+				if info, err := os.Stat(path); err != nil || info.ModTime().Equal(modTime) {
+					continue
+				}
+			}
+			if changed, err := c.reloadTimeouts(path); err != nil {
+				c.logger().log(slog.LevelError, "pqtimeouts: reloading timeouts failed", "path", path,
+					"error", err)
+			} else {
+				modTime = changed
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadTimeouts loads the timeouts from path and returns when it was last modified.
+func (c *Connector) reloadTimeouts(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := LoadTimeouts(path, c.Timeouts())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t != c.Timeouts() {
+		c.SetTimeouts(t)
+	}
+	return info.ModTime(), nil
+}
+
+// currentTimeouts returns the timeouts of the Connector the connection came from, or its own, with any overrides for
+// its host.
+func (t *timeoutConn) currentTimeouts() Timeouts {
+	if t.live != nil {
+		return t.host.apply(t.live.load())
+	}
+	return t.host.apply(Timeouts{
+		Read: t.readTimeout, Write: t.writeTimeout, IdleInTransaction: t.phaseTimeouts.idleInTransaction})
+}
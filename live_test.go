@@ -0,0 +1,123 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+func TestConnectorSetTimeouts(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT report()", pqtimeoutstest.Response{Columns: []string{"report"}, Rows: [][]string{{"ok"}},
+		Delay: 200 * time.Millisecond})
+
+	cfg, err := ParseConfig(srv.ConnString() + " read_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := NewConnector(cfg)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection already open picks up the shorter timeout.
+	connector.SetTimeouts(Timeouts{Read: 50 * time.Millisecond})
+	var report string
+	if err := db.QueryRow("SELECT report()").Scan(&report); !isTimeout(err) {
+		t.Errorf("Expected the shorter read timeout to be used, got %v", err)
+	}
+
+	connector.SetTimeouts(Timeouts{Read: time.Second})
+	if err := db.QueryRow("SELECT report()").Scan(&report); err != nil {
+		t.Errorf("Expected the longer read timeout to be used, got %v", err)
+	}
+	if timeouts := connector.Timeouts(); timeouts.Read != time.Second {
+		t.Errorf("The timeouts were not as expected: %+v", timeouts)
+	}
+}
+
+func TestSetTimeoutsCapsAdaptive(t *testing.T) {
+	testConn := &testDataConn{}
+	connector := NewConnector(Config{ReadTimeout: 5 * time.Second, AdaptiveReadTimeout: true})
+	dialer := connector.dialer()
+	dialer.netDial = func(network string, address string) (net.Conn, error) {
+		return testConn, nil
+	}
+	conn, _ := dialer.Dial("tcp", "db1:5432")
+	tc := conn.(*timeoutConn)
+	if timeout := tc.currentReadTimeout(); timeout != 5*time.Second {
+		t.Errorf("The adaptive maximum should be used until enough reads are seen: %v", timeout)
+	}
+
+	connector.SetTimeouts(Timeouts{Read: time.Second})
+	if timeout := tc.currentReadTimeout(); timeout != time.Second {
+		t.Errorf("The read timeout set should cap the adaptive timeout: %v", timeout)
+	}
+
+	for i := 0; i < adaptiveMinSamples; i++ {
+		connector.adaptive.host("db1").observe(time.Millisecond)
+	}
+	if timeout := tc.currentReadTimeout(); timeout != DefaultAdaptiveMinReadTimeout {
+		t.Errorf("A shorter learned timeout should still be used: %v", timeout)
+	}
+}
+
+func TestLoadTimeouts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeouts")
+	os.WriteFile(path, []byte("read_timeout=500\nwrite_timeout=100\n"), 0600)
+	timeouts, err := LoadTimeouts(path, Timeouts{IdleInTransaction: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts != (Timeouts{Read: 500 * time.Millisecond, Write: 100 * time.Millisecond, IdleInTransaction: time.Second}) {
+		t.Errorf("The timeouts were not as expected: %+v", timeouts)
+	}
+
+	os.WriteFile(path, []byte("read_timeout=soon"), 0600)
+	if _, err := LoadTimeouts(path, Timeouts{}); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+	os.WriteFile(path, []byte("query_timeout=500"), 0600)
+	if _, err := LoadTimeouts(path, Timeouts{}); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+}
+
+func TestConnectorReloadTimeouts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeouts")
+	os.WriteFile(path, []byte("read_timeout=500"), 0600)
+	connector := NewConnector(Config{ConnString: "dbname=pqtest", ReadTimeout: time.Second, WriteTimeout: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := connector.ReloadTimeouts(ctx, path, 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if timeouts := connector.Timeouts(); timeouts.Read != 500*time.Millisecond || timeouts.Write != time.Second {
+		t.Errorf("The timeouts were not loaded: %+v", timeouts)
+	}
+
+	os.WriteFile(path, []byte("read_timeout=200"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	for deadline := time.Now().Add(time.Second); connector.Timeouts().Read != 200*time.Millisecond; {
+		if time.Now().After(deadline) {
+			t.Fatal("The changed file was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := connector.ReloadTimeouts(ctx, filepath.Join(t.TempDir(), "missing"), 0); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
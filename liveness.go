@@ -0,0 +1,192 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Names of the built in liveness probes, for liveness_probe.
+const (
+	LivenessProbeTCP            = "tcp"
+	LivenessProbePGStatActivity = "pg_stat_activity"
+)
+
+// DefaultLivenessProbeTimeout bounds each liveness probe unless LivenessProbeTimeout is set.
+const DefaultLivenessProbeTimeout = 5 * time.Second
+
+// DefaultLivenessMax is the most a read's deadline is extended by unless LivenessMax is set.
+const DefaultLivenessMax = 10 * time.Minute
+
+// ProbeTarget identifies the backend a liveness probe checks on.
+type ProbeTarget struct {
+	Network    string
+	Address    string
+	BackendPID int // The process ID of the backend, or 0 if it isn't known (for example on TLS connections)
+}
+
+// LivenessProber checks whether the backend serving a connection is still alive. When a read times out while waiting
+// for a response, a successful probe extends the deadline instead of failing the read. Implementations must be safe
+// for concurrent use.
+type LivenessProber interface {
+	Probe(ctx context.Context, target ProbeTarget) error
+}
+
+// TCPProber checks liveness by opening a new TCP connection to the server. It shows the host is reachable and
+// accepting connections, not that the backend running the query is still working on it. Each probe costs the server a
+// forked backend, which logs "incomplete startup packet" when the probe hangs up, so it is only used when asked for with
+// liveness_probe=tcp; PGStatActivityProber is usually the better choice.
+type TCPProber struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error) // Allow this to be stubbed for testing
+}
+
+func (p TCPProber) Probe(ctx context.Context, target ProbeTarget) error {
+	dial := p.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := dial(ctx, target.Network, target.Address)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// PGStatActivityProber checks liveness by looking the backend up in pg_stat_activity over a separate connection. The
+// backend is alive while its state is active, meaning it is still running the query. Without a backend process ID it falls back to checking that the server answers a query. Its connection is opened by
+// the first probe and kept until Close. A Connector closes the prober it creates for liveness_probe when the Connector
+// (or its sql.DB) is closed; one given in Config.LivenessProber must be closed by the caller.
+type PGStatActivityProber struct {
+	connString string
+	timeout    time.Duration
+	mu         sync.Mutex
+	db         *sql.DB
+	closed     bool
+}
+
+// NewPGStatActivityProber returns a prober that connects with the lib/pq connection string connString. Reads and
+// writes on its connection time out after timeout.
+func NewPGStatActivityProber(connString string, timeout time.Duration) *PGStatActivityProber {
+	return &PGStatActivityProber{connString: connString, timeout: timeout}
+}
+
+func (p *PGStatActivityProber) Probe(ctx context.Context, target ProbeTarget) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("pqtimeouts: the liveness prober is closed")
+	}
+	if p.db == nil {
+		p.db = sql.OpenDB(NewConnector(Config{ConnString: p.connString, ReadTimeout: p.timeout, WriteTimeout: p.timeout}))
+		p.db.SetMaxOpenConns(1)
+	}
+	db := p.db
+	p.mu.Unlock()
+
+	if target.BackendPID == 0 {
+		return db.PingContext(ctx)
+	}
+	var state sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT state FROM pg_stat_activity WHERE pid = $1", target.BackendPID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("pqtimeouts: backend %d is no longer running", target.BackendPID)
+	}
+	if err != nil {
+		return err
+	}
+	if state.String != "active" {
+		return fmt.Errorf("pqtimeouts: backend %d is not running a query (state %q)", target.BackendPID, state.String)
+	}
+	return nil
+}
+
+// Close closes the prober's connection. Probes fail afterwards.
+func (p *PGStatActivityProber) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.db == nil {
+		return nil
+	}
+	return p.db.Close()
+}
+
+// liveness extends the read deadline of a connection for as long as its prober says the backend is alive.
+type liveness struct {
+	prober       LivenessProber
+	probeTimeout time.Duration
+	max          time.Duration // The most a single read may be extended by
+	owned        bool          // The prober was created for the Connector, which closes it
+}
+
+// newLiveness returns the liveness settings of cfg, or nil if it has no probe.
+func newLiveness(cfg Config) *liveness {
+	timeout := cfg.LivenessProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultLivenessProbeTimeout
+	}
+	prober, owned := cfg.LivenessProber, false
+	if prober == nil {
+		owned = true
+		switch cfg.LivenessProbe {
+		case LivenessProbeTCP:
+			prober = TCPProber{}
+		case LivenessProbePGStatActivity:
+			prober = NewPGStatActivityProber(cfg.ConnString, timeout)
+		default:
+			return nil
+		}
+	}
+	limit := cfg.LivenessMax
+	if limit <= 0 {
+		limit = DefaultLivenessMax
+	}
+	return &liveness{prober: prober, probeTimeout: timeout, max: limit, owned: owned}
+}
+
+// close closes the prober if it was created for the Connector and has anything to close.
+func (l *liveness) close() error {
+	if closer, ok := l.prober.(io.Closer); ok && l.owned {
+		return closer.Close()
+	}
+	return nil
+}
+
+// retry is called after a read of b returned n and err. While the read timed out waiting for a response and the backend
+// is alive, it reads again with a fresh deadline. A deadline set from outside the timeoutConn is never extended.
+func (l *liveness) retry(t *timeoutConn, b []byte, readTimeout time.Duration, n int, err error) (int, error) {
+	if t.protocol != nil && !t.protocol.awaitingResponse() {
+		return n, err
+	}
+
+	extended := time.Duration(0)
+	for n == 0 && isTimeout(err) && extended < l.max && t.readDeadline.externalAt().IsZero() {
+		ctx, cancel := context.WithTimeout(t.context(), l.probeTimeout)
+		probeErr := l.prober.Probe(ctx, t.probeTarget())
+		cancel()
+		if probeErr != nil {
+			t.logger.log(slog.LevelWarn, "pqtimeouts: liveness probe failed", "host", t.labels.Host, "error", probeErr)
+			return n, err
+		}
+
+		extended += readTimeout
+		t.logger.log(slog.LevelInfo, "pqtimeouts: read deadline extended", "host", t.labels.Host,
+			"extended", extended)
+		t.readDeadline.force(t.conn.SetReadDeadline, time.Now().Add(readTimeout))
+		n, err = t.conn.Read(b)
+	}
+	return n, err
+}
+
+func (t *timeoutConn) probeTarget() ProbeTarget {
+	target := ProbeTarget{Network: t.network, Address: t.address}
+	if t.protocol != nil {
+		target.BackendPID = t.protocol.currentBackendPID()
+	}
+	return target
+}
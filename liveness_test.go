@@ -0,0 +1,219 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+// testStallConn is a testNetConn whose reads time out stalls times before returning data.
+type testStallConn struct {
+	testNetConn
+	stalls int
+}
+
+func (t *testStallConn) Read(b []byte) (int, error) {
+	t.testNetConn.Read(b)
+	if t.readCalled <= t.stalls {
+		return 0, testTimeoutError{}
+	}
+	return copy(b, "data"), nil
+}
+
+type testProber struct {
+	calls  int
+	target ProbeTarget
+	err    error
+}
+
+func (p *testProber) Probe(ctx context.Context, target ProbeTarget) error {
+	p.calls++
+	p.target = target
+	return p.err
+}
+
+func TestLivenessExtendsDeadline(t *testing.T) {
+	testConn := &testStallConn{stalls: 2}
+	prober := &testProber{}
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: time.Millisecond,
+		network:     "tcp",
+		address:     "db1:5432",
+		liveness:    &liveness{prober: prober, probeTimeout: time.Second, max: time.Second}}
+
+	n, err := conn.Read(make([]byte, 4))
+	if n != 4 || err != nil {
+		t.Fatalf("Expected the read to succeed after the deadline was extended, got %d, %v", n, err)
+	}
+	if prober.calls != 2 {
+		t.Errorf("Expected 2 probes, got %d", prober.calls)
+	}
+	if prober.target.Network != "tcp" || prober.target.Address != "db1:5432" {
+		t.Errorf("Probe target was not as expected: %+v", prober.target)
+	}
+	if testConn.setReadDeadlineTime.IsZero() {
+		t.Error("The read deadline should have been extended")
+	}
+}
+
+func TestLivenessProbeFails(t *testing.T) {
+	testConn := &testStallConn{stalls: 2}
+	prober := &testProber{err: fmt.Errorf("connection refused")}
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: time.Millisecond,
+		liveness:    &liveness{prober: prober, probeTimeout: time.Second, max: time.Second}}
+
+	if _, err := conn.Read(make([]byte, 4)); !isTimeout(err) {
+		t.Errorf("Expected a timeout when the probe fails, got %v", err)
+	}
+	if testConn.readCalled != 1 {
+		t.Errorf("Expected 1 read, got %d", testConn.readCalled)
+	}
+}
+
+func TestLivenessMax(t *testing.T) {
+	testConn := &testStallConn{stalls: 10}
+	prober := &testProber{}
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: time.Millisecond,
+		liveness:    &liveness{prober: prober, probeTimeout: time.Second, max: 3 * time.Millisecond}}
+
+	if _, err := conn.Read(make([]byte, 4)); !isTimeout(err) {
+		t.Errorf("Expected a timeout once the deadline can't be extended further, got %v", err)
+	}
+	if prober.calls != 3 {
+		t.Errorf("Expected 3 probes, got %d", prober.calls)
+	}
+}
+
+func TestLivenessIdleConnection(t *testing.T) {
+	testConn := &testStallConn{stalls: 1}
+	prober := &testProber{}
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: time.Millisecond,
+		protocol:    newProtocolTracker(),
+		liveness:    &liveness{prober: prober, probeTimeout: time.Second, max: time.Second}}
+	conn.protocol.setState(StateIdle)
+
+	if _, err := conn.Read(make([]byte, 4)); !isTimeout(err) {
+		t.Errorf("Expected a timeout on an idle connection, got %v", err)
+	}
+	if prober.calls != 0 {
+		t.Errorf("An idle connection should not be probed, got %d probes", prober.calls)
+	}
+}
+
+func TestProtocolBackendPID(t *testing.T) {
+	p := newProtocolTracker()
+	p.backendMessage('K', []byte("\x00\x00\x30\x39\x00\x00\x00\x01"))
+
+	if p.backendPID != 12345 {
+		t.Errorf("Expected backend PID 12345, got %d", p.backendPID)
+	}
+}
+
+func TestTCPProber(t *testing.T) {
+	var dialed string
+	prober := TCPProber{dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		return &testNetConn{}, nil
+	}}
+
+	if err := prober.Probe(context.Background(), ProbeTarget{Network: "tcp", Address: "db1:5432"}); err != nil {
+		t.Errorf("Probe returned an error: %v", err)
+	}
+	if dialed != "db1:5432" {
+		t.Errorf("Expected db1:5432 to be dialed, got %q", dialed)
+	}
+}
+
+func TestParseConfigLiveness(t *testing.T) {
+	cfg, err := ParseConfig("user=pqtest liveness_probe=tcp liveness_probe_timeout=200 liveness_max=60000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LivenessProbe != LivenessProbeTCP || cfg.LivenessProbeTimeout != 200*time.Millisecond ||
+		cfg.LivenessMax != time.Minute {
+		t.Errorf("Liveness settings were not as expected: %+v", cfg)
+	}
+	if _, ok := newLiveness(cfg).prober.(TCPProber); !ok {
+		t.Error("Expected a TCPProber")
+	}
+
+	if _, err := ParseConfig("user=pqtest liveness_probe=ping"); err == nil {
+		t.Error("Expected an error for an unknown liveness probe")
+	}
+
+	cfg, err = ParseConfig("user=pqtest liveness_probe=tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := newLiveness(cfg).max; max != DefaultLivenessMax {
+		t.Errorf("Expected the extension to be limited to %v by default, got %v", DefaultLivenessMax, max)
+	}
+}
+
+func TestPGStatActivityProberState(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+
+	prober := NewPGStatActivityProber(srv.ConnString(), time.Second)
+	defer prober.Close()
+	target := ProbeTarget{BackendPID: 12345}
+	for _, test := range []struct {
+		response pqtimeoutstest.Response
+		alive    bool
+	}{
+		{pqtimeoutstest.Response{Columns: []string{"state"}, Rows: [][]string{{"active"}}}, true},
+		{pqtimeoutstest.Response{Columns: []string{"state"}, Rows: [][]string{{"idle"}}}, false},
+		{pqtimeoutstest.Response{Columns: []string{"state"}, Rows: [][]string{{"idle in transaction"}}}, false},
+		{pqtimeoutstest.Response{Columns: []string{"state"}}, false},
+	} {
+		srv.Handle("SELECT state FROM pg_stat_activity WHERE pid = $1", test.response)
+		if err := prober.Probe(context.Background(), target); (err == nil) != test.alive {
+			t.Errorf("Probe with rows %v returned %v", test.response.Rows, err)
+		}
+	}
+}
+
+func TestPGStatActivityProberClose(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+
+	cfg, err := ParseConfig(srv.ConnString() + " read_timeout=1000 liveness_probe=pg_stat_activity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := NewConnector(cfg)
+	prober := connector.liveness.prober.(*PGStatActivityProber)
+	if err := prober.Probe(context.Background(), ProbeTarget{}); err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+
+	db := sql.OpenDB(connector)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prober.Probe(context.Background(), ProbeTarget{}); err == nil {
+		t.Error("Closing the sql.DB should have closed the prober the Connector created")
+	}
+
+	given := NewPGStatActivityProber(srv.ConnString(), time.Second)
+	defer given.Close()
+	cfg.LivenessProber = given
+	if err := NewConnector(cfg).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := given.Probe(context.Background(), ProbeTarget{}); err != nil {
+		t.Errorf("A prober given in the Config belongs to the caller, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package pqtimeouts
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger receives structured events about connections and timeouts. The arguments after msg are alternating keys and
+// values. A *slog.Logger satisfies Logger.
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+// eventLogger sends events at or above a minimum level to a Logger.
+type eventLogger struct {
+	logger Logger
+	level  slog.Level
+}
+
+func (l eventLogger) enabled(level slog.Level) bool {
+	return l.logger != nil && level >= l.level
+}
+
+func (l eventLogger) log(level slog.Level, msg string, args ...any) {
+	if l.enabled(level) {
+		l.logger.Log(context.Background(), level, msg, args...)
+	}
+}
@@ -0,0 +1,121 @@
+package pqtimeouts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+type testLogEvent struct {
+	level slog.Level
+	msg   string
+	args  []any
+}
+
+type testLogger struct {
+	events []testLogEvent
+}
+
+func (t *testLogger) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	t.events = append(t.events, testLogEvent{level, msg, args})
+}
+
+func (t *testLogger) messages() []string {
+	var messages []string
+	for _, event := range t.events {
+		messages = append(messages, event.msg)
+	}
+	return messages
+}
+
+func TestLogDialEvents(t *testing.T) {
+	logger := &testLogger{}
+
+	dialer := timeoutDialer{
+		netDial: func(network string, address string) (net.Conn, error) {
+			if address == "bad:5432" {
+				return nil, fmt.Errorf("Could not connect")
+			}
+			return &testNetConn{}, nil
+		},
+		logger: eventLogger{logger: logger, level: slog.LevelDebug}}
+
+	dialer.Dial("tcp", "db1:5432")
+	dialer.Dial("tcp", "bad:5432")
+
+	expected := "pqtimeouts: dialing,pqtimeouts: connected,pqtimeouts: dialing,pqtimeouts: dial failed"
+	if strings.Join(logger.messages(), ",") != expected {
+		t.Errorf("Events were not as expected: %q", logger.messages())
+	}
+
+	if logger.events[3].level != slog.LevelError {
+		t.Errorf("Dial failure level was not as expected: %v", logger.events[3].level)
+	}
+}
+
+func TestLogLevelFilters(t *testing.T) {
+	logger := &testLogger{}
+
+	dialer := timeoutDialer{
+		netDial: func(network string, address string) (net.Conn, error) {
+			return &testNetConn{}, nil
+		},
+		logger: eventLogger{logger: logger, level: slog.LevelInfo}}
+
+	dialer.Dial("tcp", "db1:5432")
+
+	if len(logger.events) != 0 {
+		t.Errorf("Debug events should have been filtered: %q", logger.messages())
+	}
+}
+
+func TestLogTimeoutAndClose(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	testConn := &testNetConn{readError: testTimeoutError{}}
+
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: 500 * time.Millisecond,
+		logger:      eventLogger{logger: logger, level: slog.LevelDebug},
+		labels:      Labels{Host: "db1"}}
+
+	conn.Read(make([]byte, 5))
+	conn.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, `level=WARN msg="pqtimeouts: timeout" host=db1 direction=read timeout=500ms`) {
+		t.Errorf("Timeout event was not as expected: %s", out)
+	}
+
+	if !strings.Contains(out, `msg="pqtimeouts: connection closed" host=db1 bytes_read=0 bytes_written=0`) {
+		t.Errorf("Close event was not as expected: %s", out)
+	}
+}
+
+func TestParseConfigLogLevel(t *testing.T) {
+	cfg, err := ParseConfig("dbname=pqtest log_level=warn")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("Log level was not as expected: %v", cfg.LogLevel)
+	}
+
+	if cfg.ConnString != "dbname=pqtest" {
+		t.Errorf("The connection string was not as expected: %q", cfg.ConnString)
+	}
+
+	if _, err := ParseConfig("dbname=pqtest log_level=loud"); err == nil {
+		t.Error("An error was expected")
+	}
+}
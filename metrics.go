@@ -0,0 +1,205 @@
+package pqtimeouts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the metrics reported to a Collector.
+const (
+	MetricReadTimeouts              = "pqtimeouts_read_timeouts_total"
+	MetricWriteTimeouts             = "pqtimeouts_write_timeouts_total"
+	MetricIdleInTransactionTimeouts = "pqtimeouts_idle_in_transaction_timeouts_total"
+	MetricDialErrors                = "pqtimeouts_dial_errors_total"
+	MetricReadBytes                 = "pqtimeouts_read_bytes_total"
+	MetricWrittenBytes              = "pqtimeouts_written_bytes_total"
+	MetricConnectionsOpened         = "pqtimeouts_connections_opened_total"
+	MetricConnectionsClosed         = "pqtimeouts_connections_closed_total"
+	MetricReadDuration              = "pqtimeouts_read_duration_seconds"
+	MetricWriteDuration             = "pqtimeouts_write_duration_seconds"
+)
+
+var metricHelp = map[string]string{
+	MetricReadTimeouts:              "Reads that exceeded their deadline.",
+	MetricWriteTimeouts:             "Writes that exceeded their deadline.",
+	MetricIdleInTransactionTimeouts: "Connections dropped for being idle in a transaction for too long.",
+	MetricDialErrors:                "Connection attempts that failed.",
+	MetricReadBytes:                 "Bytes read from the database.",
+	MetricWrittenBytes:              "Bytes written to the database.",
+	MetricConnectionsOpened:         "Connections opened.",
+	MetricConnectionsClosed:         "Connections closed.",
+	MetricReadDuration:              "Time spent in each socket read.",
+	MetricWriteDuration:             "Time spent in each socket write.",
+}
+
+// Labels identify the connection a metric was recorded for.
+type Labels struct {
+	Host            string // The host part of the dialed address
+	ApplicationName string // The application_name from the connection string
+}
+
+// Collector receives metrics from the connections opened by pq-timeouts. Counters are reported with Add and
+// durations, in seconds, with Observe. Implementations must be safe for concurrent use.
+type Collector interface {
+	Add(name string, labels Labels, value float64)
+	Observe(name string, labels Labels, value float64)
+}
+
+// DefaultBuckets are the histogram bucket upper bounds, in seconds, used by NewRegistry.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricKey struct {
+	name   string
+	labels Labels
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Registry is a Collector that keeps metrics in memory and serves them in the Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	buckets    []float64
+	counters   map[metricKey]float64
+	histograms map[metricKey]*histogram
+}
+
+// NewRegistry returns an empty Registry using DefaultBuckets for histograms.
+func NewRegistry() *Registry {
+	return &Registry{
+		buckets:    DefaultBuckets,
+		counters:   make(map[metricKey]float64),
+		histograms: make(map[metricKey]*histogram)}
+}
+
+// Add increases the counter name by value.
+func (r *Registry) Add(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	r.counters[metricKey{name, labels}] += value
+	r.mu.Unlock()
+}
+
+// Observe records value in the histogram name.
+func (r *Registry) Observe(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := metricKey{name, labels}
+	h := r.histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(r.buckets))}
+		r.histograms[key] = h
+	}
+	if i := sort.SearchFloat64s(r.buckets, value); i < len(r.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// Counter returns the current value of the counter name.
+func (r *Registry) Counter(name string, labels Labels) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[metricKey{name, labels}]
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	r.writeFamilies(cw, "counter", sortedKeys(r.counters), func(key metricKey) {
+		fmt.Fprintf(cw, "%s%s %s\n", key.name, formatLabels(key.labels, ""), formatFloat(r.counters[key]))
+	})
+	r.writeFamilies(cw, "histogram", sortedKeys(r.histograms), func(key metricKey) {
+		h := r.histograms[key]
+		var cumulative uint64
+		for i, upper := range r.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", key.name, formatLabels(key.labels, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(cw, "%s_bucket%s %d\n", key.name, formatLabels(key.labels, "+Inf"), h.count)
+		fmt.Fprintf(cw, "%s_sum%s %s\n", key.name, formatLabels(key.labels, ""), formatFloat(h.sum))
+		fmt.Fprintf(cw, "%s_count%s %d\n", key.name, formatLabels(key.labels, ""), h.count)
+	})
+
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// writeFamilies writes the HELP and TYPE lines once for each metric name, followed by the samples for each key.
+func (r *Registry) writeFamilies(w io.Writer, metricType string, keys []metricKey, writeSamples func(metricKey)) {
+	for i, key := range keys {
+		if i == 0 || keys[i-1].name != key.name {
+			fmt.Fprintf(w, "# HELP %s %s\n", key.name, metricHelp[key.name])
+			fmt.Fprintf(w, "# TYPE %s %s\n", key.name, metricType)
+		}
+		writeSamples(key)
+	}
+}
+
+func sortedKeys[V any](m map[metricKey]V) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].labels.Host != keys[j].labels.Host {
+			return keys[i].labels.Host < keys[j].labels.Host
+		}
+		return keys[i].labels.ApplicationName < keys[j].labels.ApplicationName
+	})
+	return keys
+}
+
+// formatLabels formats labels for a sample line, including the le label for histogram buckets when le is not empty.
+func formatLabels(labels Labels, le string) string {
+	pairs := []string{
+		"host=" + strconv.Quote(labels.Host),
+		"application_name=" + strconv.Quote(labels.ApplicationName)}
+	if le != "" {
+		pairs = append(pairs, "le="+strconv.Quote(le))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,142 @@
+package pqtimeouts
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+func TestRegistryCounter(t *testing.T) {
+	registry := NewRegistry()
+	labels := Labels{Host: "db1", ApplicationName: "app"}
+
+	registry.Add(MetricReadBytes, labels, 10)
+	registry.Add(MetricReadBytes, labels, 5)
+
+	if registry.Counter(MetricReadBytes, labels) != 15 {
+		t.Errorf("Counter was not as expected: %v", registry.Counter(MetricReadBytes, labels))
+	}
+
+	if registry.Counter(MetricReadBytes, Labels{Host: "db2"}) != 0 {
+		t.Error("Counter for other labels should be zero")
+	}
+}
+
+func TestRegistryWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	labels := Labels{Host: "db1", ApplicationName: "app"}
+
+	registry.Add(MetricReadTimeouts, labels, 1)
+	registry.Observe(MetricReadDuration, labels, 0.003)
+	registry.Observe(MetricReadDuration, labels, 20)
+
+	var buf bytes.Buffer
+	if _, err := registry.WriteTo(&buf); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE pqtimeouts_read_timeouts_total counter\n",
+		"pqtimeouts_read_timeouts_total{host=\"db1\",application_name=\"app\"} 1\n",
+		"# TYPE pqtimeouts_read_duration_seconds histogram\n",
+		"pqtimeouts_read_duration_seconds_bucket{host=\"db1\",application_name=\"app\",le=\"0.0025\"} 0\n",
+		"pqtimeouts_read_duration_seconds_bucket{host=\"db1\",application_name=\"app\",le=\"0.005\"} 1\n",
+		"pqtimeouts_read_duration_seconds_bucket{host=\"db1\",application_name=\"app\",le=\"10\"} 1\n",
+		"pqtimeouts_read_duration_seconds_bucket{host=\"db1\",application_name=\"app\",le=\"+Inf\"} 2\n",
+		"pqtimeouts_read_duration_seconds_sum{host=\"db1\",application_name=\"app\"} 20.003\n",
+		"pqtimeouts_read_duration_seconds_count{host=\"db1\",application_name=\"app\"} 2\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line) {
+			t.Errorf("Output is missing %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.Add(MetricConnectionsOpened, Labels{Host: "db1"}, 1)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content type was not as expected: %q", recorder.Header().Get("Content-Type"))
+	}
+
+	if !strings.Contains(recorder.Body.String(), "pqtimeouts_connections_opened_total{host=\"db1\",application_name=\"\"} 1") {
+		t.Errorf("Body was not as expected: %s", recorder.Body.String())
+	}
+}
+
+func TestConnMetrics(t *testing.T) {
+	registry := NewRegistry()
+	labels := Labels{Host: "db1"}
+	testConn := &testNetConn{readError: testTimeoutError{}, writeError: fmt.Errorf("broken pipe")}
+
+	conn := &timeoutConn{conn: testConn, readTimeout: time.Second, collector: registry, labels: labels}
+
+	conn.Read(make([]byte, 5))
+	conn.Write(make([]byte, 5))
+	conn.Close()
+
+	if registry.Counter(MetricReadTimeouts, labels) != 1 {
+		t.Error("Read timeout was not counted")
+	}
+
+	if registry.Counter(MetricWriteTimeouts, labels) != 0 {
+		t.Error("Write error should not be counted as a timeout")
+	}
+
+	if registry.Counter(MetricConnectionsClosed, labels) != 1 {
+		t.Error("Close was not counted")
+	}
+
+	if registry.histograms[metricKey{MetricWriteDuration, labels}].count != 1 {
+		t.Error("Write duration was not observed")
+	}
+}
+
+func TestDialMetrics(t *testing.T) {
+	registry := NewRegistry()
+
+	dialer := timeoutDialer{
+		netDial: func(network string, address string) (net.Conn, error) {
+			if address == "bad:5432" {
+				return nil, fmt.Errorf("Could not connect")
+			}
+			return &testNetConn{}, nil
+		},
+		applicationName: "app",
+		collector:       registry}
+
+	conn, err := dialer.Dial("tcp", "db1:5432")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if _, ok := conn.(*timeoutConn); !ok {
+		t.Error("A collector should cause the connection to be wrapped")
+	}
+
+	dialer.Dial("tcp", "bad:5432")
+
+	if registry.Counter(MetricConnectionsOpened, Labels{Host: "db1", ApplicationName: "app"}) != 1 {
+		t.Error("Opened connection was not counted")
+	}
+
+	if registry.Counter(MetricDialErrors, Labels{Host: "bad", ApplicationName: "app"}) != 1 {
+		t.Error("Dial error was not counted")
+	}
+}
@@ -0,0 +1,86 @@
+package pqtimeouts
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	readTimeoutKey contextKey = iota
+	writeTimeoutKey
+)
+
+// WithReadTimeout returns a context that makes queries using it wait at most d for each read, in place of the read
+// timeout of the connection, including any adaptive read timeout. A d of 0 turns the read timeout off. It applies
+// until the connection is next used with another context, so it also covers reading the rows of a query.
+//
+//	ctx := pqtimeouts.WithReadTimeout(ctx, 30*time.Second)
+//	rows, err := db.QueryContext(ctx, "SELECT * FROM monthly_report")
+func WithReadTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, readTimeoutKey, d)
+}
+
+// WithWriteTimeout returns a context that makes queries using it wait at most d for each write, in place of the write
+// timeout of the connection. A d of 0 turns the write timeout off.
+func WithWriteTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, writeTimeoutKey, d)
+}
+
+// timeoutOverride holds the timeouts given by the context of the current operation.
+type timeoutOverride struct {
+	read, write       time.Duration
+	hasRead, hasWrite bool
+}
+
+// operation holds the context of the operation using a connection, for tracing, and the timeouts it gives. It is
+// replaced whole, as lib/pq reads the connection from another goroutine while it writes COPY data.
+type operation struct {
+	ctx      context.Context
+	override timeoutOverride
+}
+
+func overrideFrom(ctx context.Context) (o timeoutOverride) {
+	if ctx == nil {
+		return o
+	}
+	o.read, o.hasRead = ctx.Value(readTimeoutKey).(time.Duration)
+	o.write, o.hasWrite = ctx.Value(writeTimeoutKey).(time.Duration)
+	return o
+}
+
+// currentReadTimeout returns the timeout for the next read: the one given by the context, by a hint in the statement,
+// or the read timeout of the connection. An adaptive timeout is used when it is shorter than the read timeout, which
+// SetTimeouts can change, so the read timeout caps what is learned.
+func (t *timeoutConn) currentReadTimeout() time.Duration {
+	if override := t.override(); override.hasRead {
+		return override.read
+	}
+	if t.hints != nil {
+		if hint := t.hints.hint(); hint.hasRead {
+			return hint.read
+		}
+	}
+	read := t.currentTimeouts().Read
+	if t.adaptive != nil {
+		if learned := t.adaptive.timeout(); read == 0 || learned < read {
+			return learned
+		}
+	}
+	return read
+}
+
+// currentWriteTimeout returns the timeout for the next write: the one given by the context, by a hint in the
+// statement or the write timeout of the connection.
+func (t *timeoutConn) currentWriteTimeout() time.Duration {
+	if override := t.override(); override.hasWrite {
+		return override.write
+	}
+	if t.hints != nil {
+		if hint := t.hints.hint(); hint.hasWrite {
+			return hint.write
+		}
+	}
+	return t.currentTimeouts().Write
+}
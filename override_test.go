@@ -0,0 +1,126 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+func TestOverrideFrom(t *testing.T) {
+	if o := overrideFrom(nil); o.hasRead || o.hasWrite {
+		t.Error("A nil context should not override timeouts")
+	}
+	ctx := WithWriteTimeout(WithReadTimeout(context.Background(), 0), time.Second)
+	if o := overrideFrom(ctx); !o.hasRead || o.read != 0 || !o.hasWrite || o.write != time.Second {
+		t.Errorf("The override was not as expected: %+v", o)
+	}
+}
+
+func TestWithReadTimeout(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT report()", pqtimeoutstest.Response{Columns: []string{"report"}, Rows: [][]string{{"ok"}},
+		Delay: 200 * time.Millisecond})
+	srv.Handle("SELECT 1", pqtimeoutstest.Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}},
+		Delay: 200 * time.Millisecond})
+
+	for _, settings := range []string{"read_timeout=50", ""} {
+		db, err := sql.Open("pq-timeouts", srv.ConnString()+" "+settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		var report string
+		ctx := WithReadTimeout(context.Background(), time.Second)
+		if err := db.QueryRowContext(ctx, "SELECT report()").Scan(&report); err != nil {
+			t.Errorf("Expected the longer read timeout to be used with %q, got %v", settings, err)
+		}
+		ctx = WithReadTimeout(context.Background(), 50*time.Millisecond)
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&report); !isTimeout(err) {
+			t.Errorf("Expected the shorter read timeout to be used with %q, got %v", settings, err)
+		}
+	}
+}
+
+func TestWithReadTimeoutPrepared(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT report($1)", pqtimeoutstest.Response{Columns: []string{"report"}, Rows: [][]string{{"ok"}},
+		Delay: 200 * time.Millisecond})
+
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stmt, err := db.Prepare("SELECT report($1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	var report string
+	ctx := WithReadTimeout(context.Background(), time.Second)
+	if err := stmt.QueryRowContext(ctx, "monthly").Scan(&report); err != nil {
+		t.Errorf("Expected the longer read timeout to be used by the prepared statement, got %v", err)
+	}
+	if _, err := stmt.ExecContext(ctx, "monthly"); err != nil {
+		t.Errorf("Expected the longer read timeout to be used by the prepared statement, got %v", err)
+	}
+	if err := stmt.QueryRowContext(context.Background(), "monthly").Scan(&report); !isTimeout(err) {
+		t.Errorf("Expected the connection's read timeout without an override, got %v", err)
+	}
+}
+
+func TestWithReadTimeoutTransaction(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("UPDATE users SET name = 'bob'", pqtimeoutstest.Response{Tag: "UPDATE 1"})
+	srv.Handle("COMMIT", pqtimeoutstest.Response{Delay: 200 * time.Millisecond})
+	srv.Handle("ROLLBACK", pqtimeoutstest.Response{Delay: 200 * time.Millisecond})
+
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Commit and Rollback use the timeouts of the transaction's context, not those of its last statement.
+	for _, commit := range []bool{true, false} {
+		tx, err := db.BeginTx(WithReadTimeout(context.Background(), time.Second), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := WithReadTimeout(context.Background(), 50*time.Millisecond)
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET name = 'bob'"); err != nil {
+			t.Fatal(err)
+		}
+		end := tx.Rollback
+		if commit {
+			end = tx.Commit
+		}
+		if err := end(); err != nil {
+			t.Errorf("Expected the transaction's read timeout to be used with commit %t, got %v", commit, err)
+		}
+
+		tx, err = db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx = WithReadTimeout(context.Background(), time.Second)
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET name = 'bob'"); err != nil {
+			t.Fatal(err)
+		}
+		end = tx.Rollback
+		if commit {
+			end = tx.Commit
+		}
+		if err := end(); err == nil {
+			t.Errorf("Expected the connection's read timeout with commit %t, not the last statement's", commit)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package pqtimeouts
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Phase is a part of a session with its own timeout.
+type Phase string
+
+const (
+	PhaseNone              Phase = ""
+	PhaseAuth              Phase = "auth"                // From the startup message until the server is first ready
+	PhaseQuery             Phase = "query"               // From sending a query until the server is ready again
+	PhaseCopy              Phase = "copy"                // While COPY data is being sent or received
+	PhaseIdleInTransaction Phase = "idle_in_transaction" // Between statements inside a transaction
+	PhaseThroughput        Phase = "throughput"          // While a response is read below the minimum throughput
+	PhaseTLSHandshake      Phase = "tls_handshake"       // From the SSLRequest until the TLS handshake completes
+)
+
+func phaseOf(state ConnState) Phase {
+	switch state {
+	case StateStartup, StateAuth:
+		return PhaseAuth
+	case StateQuery:
+		return PhaseQuery
+	case StateCopyIn, StateCopyOut:
+		return PhaseCopy
+	case StateIdleInTransaction:
+		return PhaseIdleInTransaction
+	}
+	return PhaseNone
+}
+
+// TimeoutError is returned when a phase of a session takes longer than its timeout. It is a net.Error whose Timeout
+// method returns true. The connection is unusable afterwards.
+type TimeoutError struct {
+	Phase Phase
+	Limit time.Duration // The timeout that was exceeded
+	Err   error         // The error from the connection when the deadline was exceeded, if any
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("pqtimeouts: %s timeout of %v exceeded", e.Phase, e.Limit)
+}
+
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return false }
+func (e *TimeoutError) Unwrap() error   { return e.Err }
+
+// phaseTimeouts are the timeouts for each Phase. A zero timeout is not enforced.
+type phaseTimeouts struct {
+	auth              time.Duration
+	query             time.Duration
+	copy              time.Duration
+	idleInTransaction time.Duration
+}
+
+func (p phaseTimeouts) any() bool {
+	return p.auth != 0 || p.query != 0 || p.copy != 0 || p.idleInTransaction != 0
+}
+
+func (p phaseTimeouts) of(phase Phase) time.Duration {
+	switch phase {
+	case PhaseAuth:
+		return p.auth
+	case PhaseQuery:
+		return p.query
+	case PhaseCopy:
+		return p.copy
+	case PhaseIdleInTransaction:
+		return p.idleInTransaction
+	}
+	return 0
+}
+
+// deadline returns the deadline for an I/O operation starting at now that would otherwise be bounded by timeout. If
+// the current phase's timeout ends sooner, its deadline is used and the phase is returned so a timeout can be
+// reported as a TimeoutError. Idle in transaction is enforced when the next write starts rather than by a deadline.
+func (t *timeoutConn) deadline(now time.Time, timeout time.Duration) (deadline time.Time, phase Phase) {
+	if timeout != 0 {
+		deadline = now.Add(timeout)
+	}
+	if t.protocol == nil {
+		return deadline, PhaseNone
+	}
+
+	current, phaseStart := t.protocol.currentPhase()
+	phaseTimeout := t.phaseTimeouts.of(current)
+	if phaseTimeout == 0 || current == PhaseIdleInTransaction {
+		return deadline, PhaseNone
+	}
+	phaseDeadline := phaseStart.Add(phaseTimeout)
+	if deadline.IsZero() || phaseDeadline.Before(deadline) {
+		return phaseDeadline, current
+	}
+	return deadline, PhaseNone
+}
+
+// phaseError wraps err in a TimeoutError when it is the deadline of phase that was exceeded.
+func (t *timeoutConn) phaseError(err error, phase Phase) error {
+	if phase == PhaseNone || !isTimeout(err) {
+		return err
+	}
+	return &TimeoutError{Phase: phase, Limit: t.phaseLimit(phase), Err: err}
+}
+
+// phaseLimit returns the timeout of phase. Throughput is limited by how long it may stay below the minimum.
+func (t *timeoutConn) phaseLimit(phase Phase) time.Duration {
+	if phase == PhaseThroughput {
+		return t.throughput.grace
+	}
+	return t.phaseTimeouts.of(phase)
+}
+
+// idleTimer closes a connection left idle in a transaction for too long, which no later write may ever notice.
+type idleTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	err   error // The TimeoutError the connection was closed with
+}
+
+// arm calls expired after d, unless the timer is already armed or is stopped first.
+func (i *idleTimer) arm(d time.Duration, expired func()) {
+	i.mu.Lock()
+	if i.timer == nil {
+		i.timer = time.AfterFunc(d, expired)
+	}
+	i.mu.Unlock()
+}
+
+// expired returns the TimeoutError the timer closed the connection with, if it did.
+func (i *idleTimer) expired() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.err
+}
+
+// closedWith records err as the TimeoutError the connection was closed with, unless one already is.
+func (i *idleTimer) closedWith(err error) {
+	i.mu.Lock()
+	if i.err == nil {
+		i.err = err
+	}
+	i.mu.Unlock()
+}
+
+func (i *idleTimer) stop() {
+	i.mu.Lock()
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+	i.mu.Unlock()
+}
+
+// armIdleInTransaction starts the idle in transaction timer when the connection has become idle in a transaction.
+func (t *timeoutConn) armIdleInTransaction() {
+	phase, phaseStart := t.protocol.currentPhase()
+	if phase != PhaseIdleInTransaction {
+		return
+	}
+	limit := t.currentTimeouts().IdleInTransaction
+	if limit == 0 {
+		return
+	}
+	t.idleTimer.arm(time.Until(phaseStart.Add(limit)), func() {
+		// The server would otherwise keep the transaction open, so give up on the connection.
+		t.idleTimer.closedWith(&TimeoutError{Phase: PhaseIdleInTransaction, Limit: limit})
+		if t.collector != nil {
+			t.collector.Add(MetricIdleInTransactionTimeouts, t.labels, 1)
+		}
+		t.logger.log(slog.LevelWarn, "pqtimeouts: timeout", "host", t.labels.Host, "direction", "idle",
+			"timeout", limit, "phase", string(PhaseIdleInTransaction))
+		t.Close()
+	})
+}
+
+// idleInTransactionExceeded reports whether the connection has been idle in a transaction for longer than allowed.
+func (t *timeoutConn) idleInTransactionExceeded(now time.Time) bool {
+	if t.protocol == nil {
+		return false
+	}
+	phase, phaseStart := t.protocol.currentPhase()
+	if phase != PhaseIdleInTransaction {
+		return false
+	}
+	limit := t.currentTimeouts().IdleInTransaction
+	return limit != 0 && now.Sub(phaseStart) > limit
+}
+
+// badConnError is the driver.ErrBadConn lib/pq returns for a connection pq-timeouts closed, carrying the TimeoutError
+// it was closed with. database/sql still sees driver.ErrBadConn, and errors.As finds the TimeoutError.
+type badConnError struct {
+	err error
+}
+
+func (e *badConnError) Error() string   { return e.err.Error() }
+func (e *badConnError) Unwrap() []error { return []error{e.err, driver.ErrBadConn} }
+
+// driverError returns err from lib/pq with the TimeoutError the connection was closed with, if lib/pq reported it only
+// as driver.ErrBadConn.
+func (t *timeoutConn) driverError(err error) error {
+	if !errors.Is(err, driver.ErrBadConn) {
+		return err
+	}
+	if closeErr := t.idleTimer.expired(); closeErr != nil {
+		return &badConnError{err: closeErr}
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package pqtimeouts
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+)
+
+// trackedConn returns a timeoutConn over testConn whose tracker has been taken through startup to idle.
+func trackedConn(testConn net.Conn, timeouts phaseTimeouts) *timeoutConn {
+	conn := &timeoutConn{conn: testConn, protocol: newProtocolTracker(), phaseTimeouts: timeouts}
+	conn.protocol.wrote(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	conn.protocol.read(append(authMessage(0), backendMessage('Z', "I")...))
+	return conn
+}
+
+func TestQueryTimeoutDeadline(t *testing.T) {
+	testConn := &testNetConn{readError: testTimeoutError{}}
+	conn := trackedConn(testConn, phaseTimeouts{query: 100 * time.Millisecond})
+	conn.readTimeout = time.Minute
+
+	conn.protocol.wrote(backendMessage('Q', "SELECT pg_sleep(10)\x00"))
+	queryStart := conn.protocol.phaseStart
+	_, err := conn.Read(make([]byte, 5))
+
+	if testConn.setReadDeadlineTime != queryStart.Add(100*time.Millisecond) {
+		t.Errorf("The query deadline was not used: %v", testConn.setReadDeadlineTime)
+	}
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("A TimeoutError was expected: %v", err)
+	}
+
+	if timeoutErr.Phase != PhaseQuery || timeoutErr.Limit != 100*time.Millisecond {
+		t.Errorf("The TimeoutError was not as expected: %+v", timeoutErr)
+	}
+
+	if err.Error() != "pqtimeouts: query timeout of 100ms exceeded" {
+		t.Errorf("The error message was not as expected: %q", err.Error())
+	}
+
+	if !isTimeout(err) || !errors.Is(err, testTimeoutError{}) {
+		t.Error("The TimeoutError should be a timeout wrapping the connection error")
+	}
+}
+
+func TestReadTimeoutSoonerThanPhase(t *testing.T) {
+	testConn := &testNetConn{readError: testTimeoutError{}}
+	conn := trackedConn(testConn, phaseTimeouts{query: time.Minute})
+	conn.readTimeout = 100 * time.Millisecond
+
+	conn.protocol.wrote(backendMessage('Q', "SELECT 1\x00"))
+	_, err := conn.Read(make([]byte, 5))
+
+	if _, ok := err.(*TimeoutError); ok {
+		t.Error("A read timeout should not be reported as a phase timeout")
+	}
+}
+
+func TestCopyTimeout(t *testing.T) {
+	testConn := &testNetConn{writeError: testTimeoutError{}}
+	conn := trackedConn(testConn, phaseTimeouts{query: time.Millisecond, copy: time.Hour})
+
+	conn.protocol.wrote(backendMessage('Q', "COPY t FROM STDIN\x00"))
+	conn.protocol.read(backendMessage('G', "\x00\x00\x00"))
+	copyStart := conn.protocol.phaseStart
+	_, err := conn.Write(backendMessage('d', "1\t2\n"))
+
+	if testConn.setWriteDeadlineTime != copyStart.Add(time.Hour) {
+		t.Errorf("The copy deadline was not used: %v", testConn.setWriteDeadlineTime)
+	}
+
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Phase != PhaseCopy {
+		t.Errorf("A copy TimeoutError was expected: %v", err)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	testConn := &testDataConn{testNetConn: testNetConn{readError: testTimeoutError{}}}
+	conn := &timeoutConn{conn: testConn, protocol: newProtocolTracker(), phaseTimeouts: phaseTimeouts{auth: time.Second}}
+
+	conn.Write(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	_, err := conn.Read(make([]byte, 5))
+
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Phase != PhaseAuth {
+		t.Errorf("An auth TimeoutError was expected: %v", err)
+	}
+}
+
+func TestIdleInTransactionTimeout(t *testing.T) {
+	testConn := &testNetConn{}
+	conn := trackedConn(testConn, phaseTimeouts{idleInTransaction: time.Millisecond})
+
+	conn.protocol.wrote(backendMessage('Q', "BEGIN\x00"))
+	conn.protocol.read(append(backendMessage('C', "BEGIN\x00"), backendMessage('Z', "T")...))
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := conn.Write(backendMessage('Q', "COMMIT\x00"))
+
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Phase != PhaseIdleInTransaction {
+		t.Errorf("An idle in transaction TimeoutError was expected: %v", err)
+	}
+
+	if testConn.writeCalled != 0 {
+		t.Error("The statement should not have been sent")
+	}
+
+	if testConn.closeCalled != 1 {
+		t.Error("The connection should have been closed")
+	}
+}
+
+func TestIdleInTransactionWithinTimeout(t *testing.T) {
+	testConn := &testNetConn{}
+	conn := trackedConn(testConn, phaseTimeouts{idleInTransaction: time.Minute})
+
+	conn.protocol.wrote(backendMessage('Q', "BEGIN\x00"))
+	conn.protocol.read(append(backendMessage('C', "BEGIN\x00"), backendMessage('Z', "T")...))
+
+	if _, err := conn.Write(backendMessage('Q', "COMMIT\x00")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if testConn.setWriteDeadlineCalled != 0 {
+		t.Error("Idle in transaction should not set a deadline")
+	}
+}
+
+func TestIdleInTransactionLeaked(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	registry := NewRegistry()
+	cfg, err := ParseConfig(srv.ConnString() + " idle_in_transaction_timeout=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Collector = registry
+	db := sql.OpenDB(NewConnector(cfg))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE users SET name = 'bob'"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction is never touched again, so only a timer can notice it.
+	time.Sleep(300 * time.Millisecond)
+	if closed := registry.Counter(MetricConnectionsClosed, Labels{Host: "127.0.0.1"}); closed != 1 {
+		t.Errorf("The connection should have been closed while idle, %v were", closed)
+	}
+	if timeouts := registry.Counter(MetricIdleInTransactionTimeouts, Labels{Host: "127.0.0.1"}); timeouts != 1 {
+		t.Errorf("Expected one idle in transaction timeout to be counted, got %v", timeouts)
+	}
+	_, err = tx.Exec("UPDATE users SET name = 'carol'")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Phase != PhaseIdleInTransaction {
+		t.Errorf("An idle in transaction TimeoutError was expected: %v", err)
+	}
+	tx.Rollback()
+}
+
+func TestIdleInTransactionTimerStopped(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" idle_in_transaction_timeout=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each statement restarts the timer, so a transaction busier than the timeout stays open.
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if _, err := tx.Exec("UPDATE users SET name = 'bob'"); err != nil {
+			t.Fatalf("Statement %d failed: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseConfigPhaseTimeouts(t *testing.T) {
+	cfg, err := ParseConfig("dbname=pqtest auth_timeout=1 query_timeout=2 copy_timeout=3 idle_in_transaction_timeout=4")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if cfg.AuthTimeout != time.Millisecond || cfg.QueryTimeout != 2*time.Millisecond ||
+		cfg.CopyTimeout != 3*time.Millisecond || cfg.IdleInTransactionTimeout != 4*time.Millisecond {
+		t.Errorf("Phase timeouts were not as expected: %+v", cfg)
+	}
+
+	if cfg.ConnString != "dbname=pqtest" {
+		t.Errorf("The connection string was not as expected: %q", cfg.ConnString)
+	}
+
+	dialer := NewConnector(cfg).dialer()
+	if !dialer.tracksProtocol() {
+		t.Error("Phase timeouts should turn on protocol tracking")
+	}
+}
@@ -32,5 +32,16 @@ Connections using a URL work as well:
 read_timeout and write_timeout are specified in milliseconds. If read_timeout or write_timeout are not specified or set to 0,
 no timeout is set and the driver behaves as standard lib/pq. For other connection options, check out the documentation for lib/pq:
 https://godoc.org/github.com/lib/pq
+
+Settings that can't be expressed in a connection string, such as a metrics Collector, are set on a Config and used
+through a Connector:
+
+
+	cfg, err := pqtimeouts.ParseConfig("user=pqtest dbname=pqtest read_timeout=500")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Collector = pqtimeouts.NewRegistry()
+	db := sql.OpenDB(pqtimeouts.NewConnector(cfg))
 */
 package pqtimeouts
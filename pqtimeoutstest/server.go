@@ -0,0 +1,784 @@
+// Package pqtimeoutstest provides a fake Postgres server for end-to-end tests of timeout behavior.
+//
+// The server speaks enough of the Postgres wire protocol for lib/pq to connect and run queries, using either the
+// simple or the extended query protocol, inside transactions or not, and to COPY data in either direction. Each query
+// is answered with a scripted Response, which can delay, hang or disconnect part way through:
+//
+//	srv := pqtimeoutstest.NewServer()
+//	defer srv.Close()
+//	srv.Handle("SELECT 1", pqtimeoutstest.Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+//	srv.Handle("SELECT pg_sleep(10)", pqtimeoutstest.Response{Hang: true})
+//
+//	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=100")
+package pqtimeoutstest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Startup describes how the server handles a new connection.
+type Startup struct {
+	Delay      time.Duration // Before answering the startup message
+	Password   string        // Ask for this cleartext password when set
+	Hang       bool          // Never answer the startup message
+	Disconnect bool          // Close the connection instead of answering the startup message
+	TLSConfig  *tls.Config   // Accept SSLRequests and encrypt the connection with this when set
+}
+
+// Response describes how the server answers a query. Columns are sent as text. Without Columns the query is answered
+// as a command that returns no rows.
+type Response struct {
+	Columns  []string
+	Rows     [][]string
+	Tag      string        // The command tag, "SELECT <rows>" by default when there are Columns and "OK" otherwise
+	Error    string        // Answer with an error with this message instead
+	Delay    time.Duration // Before the response. A statement_timeout given when connecting cancels longer delays.
+	RowDelay time.Duration // Before each row
+
+	// CopyIn answers with a CopyInResponse and reads COPY data until the client finishes, for COPY ... FROM STDIN.
+	// CopyOut answers with a CopyOutResponse and sends these lines as COPY data, for COPY ... TO STDOUT.
+	CopyIn  bool
+	CopyOut []string
+
+	// Hang or disconnect after sending the columns and rows, or after reading the COPY data, instead of completing the
+	// response. With no columns or rows the server hangs or disconnects as soon as the query arrives.
+	Hang       bool
+	Disconnect bool
+}
+
+func (r Response) tag() string {
+	switch {
+	case r.Tag != "":
+		return r.Tag
+	case len(r.Columns) > 0:
+		return "SELECT " + strconv.Itoa(len(r.Rows))
+	case r.CopyOut != nil:
+		return "COPY " + strconv.Itoa(len(r.CopyOut))
+	}
+	return "OK"
+}
+
+// Server is a fake Postgres server listening on a local port.
+type Server struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	startup   Startup
+	responses map[string]Response
+	handler   func(query string) Response
+	queries   []string
+	copied    []string
+	cancels   int
+	conns     map[net.Conn]bool
+	closed    chan struct{}
+	nextPID   uint32
+	wg        sync.WaitGroup
+}
+
+// NewServer starts a server on a local port. It answers every query with an empty Response until told otherwise.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("pqtimeoutstest: failed to listen on a port: %v", err))
+	}
+	s := &Server{
+		listener:  l,
+		responses: make(map[string]Response),
+		conns:     make(map[net.Conn]bool),
+		closed:    make(chan struct{}),
+		nextPID:   1000}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// ConnString returns a lib/pq connection string for the server, which further settings can be appended to.
+func (s *Server) ConnString() string {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	return fmt.Sprintf("host=%s port=%s user=pqtest dbname=pqtest sslmode=disable", host, port)
+}
+
+// SetStartup changes how new connections are handled.
+func (s *Server) SetStartup(startup Startup) {
+	s.mu.Lock()
+	s.startup = startup
+	s.mu.Unlock()
+}
+
+// Handle sets the response to query, which must match the text sent exactly.
+func (s *Server) Handle(query string, r Response) {
+	s.mu.Lock()
+	s.responses[query] = r
+	s.mu.Unlock()
+}
+
+// HandleFunc sets a function answering the queries that have no response set by Handle. It can be called more than
+// once for a query using the extended protocol, and must be safe for concurrent use.
+func (s *Server) HandleFunc(f func(query string) Response) {
+	s.mu.Lock()
+	s.handler = f
+	s.mu.Unlock()
+}
+
+// Queries returns the text of the queries received so far, in order.
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Copied returns the lines of COPY data received so far, in order.
+func (s *Server) Copied() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.copied...)
+}
+
+// Cancels returns how many cancel requests have been received.
+func (s *Server) Cancels() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancels
+}
+
+// Close stops the server and closes all its connections, ending any hangs.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(s.closed)
+	s.listener.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		select {
+		case <-s.closed:
+			s.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		s.conns[c] = true
+		s.nextPID++
+		pid := s.nextPID
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			sc := &serverConn{server: s, conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c), pid: pid, status: 'I'}
+			sc.serve()
+			c.Close()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// response returns how to answer query, recording it when the answer is about to be sent.
+func (s *Server) response(query string, record bool) Response {
+	s.mu.Lock()
+	if record {
+		s.queries = append(s.queries, query)
+	}
+	r, ok := s.responses[query]
+	handler := s.handler
+	s.mu.Unlock()
+
+	if !ok && handler != nil {
+		return handler(query)
+	}
+	return r
+}
+
+// sleep waits for d, returning false if the server is closed first.
+func (s *Server) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.closed:
+		return false
+	}
+}
+
+// Codes of the untyped messages a client can send first.
+const (
+	protocolVersion3 = 196608
+	cancelRequest    = 80877102
+	sslRequest       = 80877103
+	gssEncRequest    = 80877104
+)
+
+// Type OIDs used in descriptions.
+const (
+	oidText = 25
+)
+
+// errHang ends a connection's loop without answering, leaving the client waiting.
+var errHang = fmt.Errorf("pqtimeoutstest: hang")
+
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	pid    uint32
+	status byte // The transaction status sent in ReadyForQuery: 'I' when idle, 'T' in a transaction, 'E' in a failed one
+
+	statementTimeout time.Duration // From the startup message, cancelling queries delayed for longer when set
+
+	statements map[string]string // Query text of prepared statements by name
+	portals    map[string]string // Query text of bound portals by name
+	failed     bool              // An extended protocol error was sent, so messages are skipped until Sync
+}
+
+func (c *serverConn) serve() {
+	err := c.startup()
+	if err == nil {
+		err = c.queries()
+	}
+	if err == errHang {
+		// Keep reading so the hang ends when the client gives up, or the server closes the connection.
+		io.Copy(io.Discard, c.r)
+	}
+}
+
+// startup handles the startup message and authentication.
+func (c *serverConn) startup() error {
+	for started := false; !started; {
+		body, err := c.readUntyped()
+		if err != nil {
+			return err
+		}
+		if len(body) < 4 {
+			return fmt.Errorf("pqtimeoutstest: short startup message")
+		}
+		switch binary.BigEndian.Uint32(body) {
+		case sslRequest:
+			c.server.mu.Lock()
+			config := c.server.startup.TLSConfig
+			c.server.mu.Unlock()
+			if config == nil {
+				if _, err := c.conn.Write([]byte{'N'}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := c.conn.Write([]byte{'S'}); err != nil {
+				return err
+			}
+			c.conn = tls.Server(c.conn, config)
+			c.r, c.w = bufio.NewReader(c.conn), bufio.NewWriter(c.conn)
+		case gssEncRequest:
+			// Refuse encryption, and wait for the real startup message.
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case cancelRequest:
+			c.server.mu.Lock()
+			c.server.cancels++
+			c.server.mu.Unlock()
+			return io.EOF
+		case protocolVersion3:
+			started = true
+			c.statementTimeout = statementTimeout(body[4:])
+		default:
+			return fmt.Errorf("pqtimeoutstest: unsupported protocol")
+		}
+	}
+
+	c.server.mu.Lock()
+	startup := c.server.startup
+	c.server.mu.Unlock()
+	if !c.server.sleep(startup.Delay) {
+		return io.EOF
+	}
+	switch {
+	case startup.Hang:
+		return errHang
+	case startup.Disconnect:
+		return io.EOF
+	}
+
+	if startup.Password != "" {
+		c.message('R', uint32Bytes(3))
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if password, _ := cString(body); typ != 'p' || password != startup.Password {
+			c.error("28P01", "password authentication failed")
+			c.w.Flush()
+			return io.EOF
+		}
+	}
+
+	c.message('R', uint32Bytes(0))
+	c.parameterStatus("server_version", "16.0.0")
+	c.parameterStatus("client_encoding", "UTF8")
+	c.parameterStatus("TimeZone", "UTC")
+	c.message('K', append(uint32Bytes(c.pid), uint32Bytes(c.pid)...))
+	c.message('Z', []byte{c.status})
+	return c.w.Flush()
+}
+
+// queries answers messages until the client terminates or disconnects.
+func (c *serverConn) queries() error {
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if c.failed && typ != 'S' && typ != 'X' {
+			continue
+		}
+
+		switch typ {
+		case 'Q':
+			query, _ := cString(body)
+			if err := c.simpleQuery(query); err != nil {
+				return err
+			}
+		case 'P':
+			name, rest := cString(body)
+			query, _ := cString(rest)
+			c.prepare(name, query)
+			c.message('1', nil)
+		case 'B':
+			portal, rest := cString(body)
+			name, _ := cString(rest)
+			query, ok := c.statements[name]
+			if !ok {
+				c.extendedError("26000", fmt.Sprintf("prepared statement %q does not exist", name))
+				continue
+			}
+			if c.portals == nil {
+				c.portals = make(map[string]string)
+			}
+			c.portals[portal] = query
+			c.message('2', nil)
+		case 'D':
+			if len(body) == 0 {
+				continue
+			}
+			name, _ := cString(body[1:])
+			query, ok := c.statements[name]
+			if body[0] == 'P' {
+				query, ok = c.portals[name]
+			}
+			if !ok {
+				c.extendedError("26000", fmt.Sprintf("%q does not exist", name))
+				continue
+			}
+			c.describe(query, body[0] == 'S')
+		case 'E':
+			portal, _ := cString(body)
+			query, ok := c.portals[portal]
+			if !ok {
+				c.extendedError("34000", fmt.Sprintf("portal %q does not exist", portal))
+				continue
+			}
+			if err := c.execute(query, false); err != nil {
+				return err
+			}
+		case 'C':
+			if len(body) > 0 {
+				name, _ := cString(body[1:])
+				if body[0] == 'S' {
+					delete(c.statements, name)
+				} else {
+					delete(c.portals, name)
+				}
+			}
+			c.message('3', nil)
+		case 'H':
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		case 'S':
+			c.failed = false
+			c.message('Z', []byte{c.status})
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		case 'X':
+			return io.EOF
+		default:
+			c.extendedError("08P01", fmt.Sprintf("unsupported message type %q", typ))
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *serverConn) prepare(name, query string) {
+	if c.statements == nil {
+		c.statements = make(map[string]string)
+	}
+	c.statements[name] = query
+}
+
+// describe answers a Describe message, with the parameters as well as the columns for a statement.
+func (c *serverConn) describe(query string, statement bool) {
+	if statement {
+		params := parameterCount(query)
+		b := uint16Bytes(params)
+		for i := 0; i < params; i++ {
+			b = append(b, uint32Bytes(oidText)...)
+		}
+		c.message('t', b)
+	}
+	r := c.server.response(query, false)
+	if len(r.Columns) == 0 {
+		c.message('n', nil)
+		return
+	}
+	c.rowDescription(r.Columns)
+}
+
+func (c *serverConn) simpleQuery(query string) error {
+	err := c.execute(query, true)
+	if err != nil {
+		return err
+	}
+	c.message('Z', []byte{c.status})
+	return c.w.Flush()
+}
+
+// execute sends the response to query, including its row description for the simple query protocol.
+func (c *serverConn) execute(query string, simple bool) error {
+	r := c.server.response(query, true)
+	code := "XX000"
+	if c.statementTimeout > 0 && r.Delay > c.statementTimeout {
+		r, code = Response{Delay: c.statementTimeout, Error: "canceling statement due to statement timeout"}, "57014"
+	}
+	if !c.server.sleep(r.Delay) {
+		return io.EOF
+	}
+	command := transactionCommand(query)
+	if c.status == 'E' && command != "COMMIT" && command != "ROLLBACK" {
+		r = Response{Error: "current transaction is aborted, commands ignored until end of transaction block"}
+	}
+	if r.Error != "" {
+		if c.status == 'T' {
+			c.status = 'E'
+		}
+		if simple {
+			c.error(code, r.Error)
+		} else {
+			c.extendedError(code, r.Error)
+		}
+		return nil
+	}
+
+	if command != "" && r.Tag == "" && len(r.Columns) == 0 {
+		// A failed transaction is rolled back however it ends.
+		r.Tag = command
+		if c.status == 'E' {
+			r.Tag = "ROLLBACK"
+		}
+	}
+	switch command {
+	case "BEGIN", "START TRANSACTION":
+		c.status = 'T'
+	case "COMMIT", "ROLLBACK":
+		c.status = 'I'
+	}
+	if r.CopyIn {
+		return c.copyIn(r)
+	}
+	if r.CopyOut != nil {
+		c.copyOut(r)
+	}
+
+	if simple && len(r.Columns) > 0 {
+		c.rowDescription(r.Columns)
+	}
+	for _, row := range r.Rows {
+		if r.RowDelay > 0 {
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+			if !c.server.sleep(r.RowDelay) {
+				return io.EOF
+			}
+		}
+		b := uint16Bytes(len(row))
+		for _, value := range row {
+			b = append(b, uint32Bytes(uint32(len(value)))...)
+			b = append(b, value...)
+		}
+		c.message('D', b)
+	}
+
+	if r.Hang || r.Disconnect {
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if r.Hang {
+			return errHang
+		}
+		return io.EOF
+	}
+	if simple && len(r.Columns) == 0 && r.Tag == "" && query == "" {
+		c.message('I', nil)
+		return nil
+	}
+	c.message('C', append([]byte(r.tag()), 0))
+	return nil
+}
+
+// copyIn answers a COPY ... FROM STDIN, reading COPY data until the client sends CopyDone or CopyFail.
+func (c *serverConn) copyIn(r Response) error {
+	c.message('G', []byte{0, 0, 0})
+	var data []byte
+	for done := false; !done; {
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'd':
+			data = append(data, body...)
+		case 'c':
+			done = true
+		case 'f':
+			message, _ := cString(body)
+			c.error("57014", "COPY from stdin failed: "+message)
+			if c.status == 'T' {
+				c.status = 'E'
+			}
+			return nil
+		case 'H', 'S':
+		default:
+			return fmt.Errorf("pqtimeoutstest: unexpected message %q during COPY", typ)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	c.server.mu.Lock()
+	c.server.copied = append(c.server.copied, lines...)
+	c.server.mu.Unlock()
+	if r.Hang || r.Disconnect {
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if r.Hang {
+			return errHang
+		}
+		return io.EOF
+	}
+	tag := r.Tag
+	if tag == "" {
+		tag = "COPY " + strconv.Itoa(len(lines))
+	}
+	c.message('C', append([]byte(tag), 0))
+	return nil
+}
+
+// copyOut sends the lines of a COPY ... TO STDOUT, leaving the command tag to follow.
+func (c *serverConn) copyOut(r Response) {
+	c.message('H', []byte{0, 0, 0})
+	for _, line := range r.CopyOut {
+		c.message('d', []byte(line+"\n"))
+	}
+	c.message('c', nil)
+}
+
+// statementTimeout returns the statement_timeout among the parameters of a startup message, given on its own or in
+// options, or 0 if there is none.
+func statementTimeout(params []byte) time.Duration {
+	var value string
+	for len(params) > 1 {
+		var name, v string
+		name, params = cString(params)
+		v, params = cString(params)
+		switch name {
+		case "statement_timeout":
+			value = v
+		case "options":
+			for _, option := range strings.Fields(v) {
+				if v, ok := strings.CutPrefix(strings.TrimPrefix(option, "-c"), "statement_timeout="); ok {
+					value = v
+				}
+			}
+		}
+	}
+	unit := time.Millisecond
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"ms", time.Millisecond}, {"min", time.Minute}, {"s", time.Second}} {
+		if v, ok := strings.CutSuffix(value, u.suffix); ok {
+			value, unit = v, u.unit
+			break
+		}
+	}
+	n, _ := strconv.Atoi(value)
+	return time.Duration(n) * unit
+}
+
+// transactionCommand returns the command a query starts or ends a transaction with, as its command tag, or "".
+func transactionCommand(query string) string {
+	fields := strings.Fields(strings.ToUpper(query))
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "BEGIN":
+		return "BEGIN"
+	case "START":
+		return "START TRANSACTION"
+	case "COMMIT", "END":
+		return "COMMIT"
+	case "ROLLBACK", "ABORT":
+		return "ROLLBACK"
+	}
+	return ""
+}
+
+func (c *serverConn) rowDescription(columns []string) {
+	b := uint16Bytes(len(columns))
+	for _, name := range columns {
+		b = append(b, name...)
+		b = append(b, 0)
+		b = append(b, uint32Bytes(0)...)       // Table
+		b = append(b, uint16Bytes(0)...)       // Column number
+		b = append(b, uint32Bytes(oidText)...) // Type
+		b = append(b, 0xff, 0xff)              // Type size, -1 for variable length
+		b = append(b, 0xff, 0xff, 0xff, 0xff)  // Type modifier
+		b = append(b, uint16Bytes(0)...)       // Text format
+	}
+	c.message('T', b)
+}
+
+func (c *serverConn) parameterStatus(name, value string) {
+	c.message('S', append(append(append([]byte(name), 0), value...), 0))
+}
+
+// error sends an ErrorResponse.
+func (c *serverConn) error(code, message string) {
+	b := []byte{'S'}
+	b = append(b, "ERROR\x00"...)
+	b = append(b, 'C')
+	b = append(b, code...)
+	b = append(b, 0, 'M')
+	b = append(b, message...)
+	b = append(b, 0, 0)
+	c.message('E', b)
+}
+
+// extendedError sends an ErrorResponse and skips messages until the next Sync, as the extended protocol requires.
+func (c *serverConn) extendedError(code, message string) {
+	c.error(code, message)
+	c.failed = true
+}
+
+func (c *serverConn) message(typ byte, body []byte) {
+	c.w.WriteByte(typ)
+	c.w.Write(uint32Bytes(uint32(len(body) + 4)))
+	c.w.Write(body)
+}
+
+// read reads a typed message, flushing anything pending first.
+func (c *serverConn) read() (byte, []byte, error) {
+	if err := c.w.Flush(); err != nil {
+		return 0, nil, err
+	}
+	typ, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	body, err := c.readUntyped()
+	return typ, body, err
+}
+
+// readUntyped reads the length and body of a message.
+func (c *serverConn) readUntyped() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(header[:])) - 4
+	if n < 0 || n > 1<<30 {
+		return nil, fmt.Errorf("pqtimeoutstest: invalid message length")
+	}
+	body := make([]byte, n)
+	_, err := io.ReadFull(c.r, body)
+	return body, err
+}
+
+var parameterPattern = regexp.MustCompile(`\$(\d+)`)
+
+// parameterCount returns the highest $n placeholder in query.
+func parameterCount(query string) int {
+	count := 0
+	for _, m := range parameterPattern.FindAllStringSubmatch(query, -1) {
+		if n, _ := strconv.Atoi(m[1]); n > count {
+			count = n
+		}
+	}
+	return count
+}
+
+// cString returns the null terminated string at the start of b and the bytes after it.
+func cString(b []byte) (string, []byte) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:]
+		}
+	}
+	return string(b), nil
+}
+
+func uint32Bytes(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+func uint16Bytes(n int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(n))
+}
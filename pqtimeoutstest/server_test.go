@@ -0,0 +1,320 @@
+package pqtimeoutstest
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pqtimeouts "github.com/Kount/pq-timeouts"
+)
+
+func open(t *testing.T, srv *Server, settings string) *sql.DB {
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" "+settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestSimpleQuery(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT name FROM users", Response{Columns: []string{"name"}, Rows: [][]string{{"alice"}, {"bob"}}})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "alice" || names[1] != "bob" {
+		t.Errorf("Rows were not as expected: %v", names)
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT name FROM users WHERE id = $1", Response{Columns: []string{"name"}, Rows: [][]string{{"alice"}}})
+	srv.Handle("UPDATE users SET name = $1 WHERE id = $2", Response{Tag: "UPDATE 3"})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	var name string
+	if err := db.QueryRow("SELECT name FROM users WHERE id = $1", 1).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "alice" {
+		t.Errorf("Expected alice, got %q", name)
+	}
+
+	result, err := db.Exec("UPDATE users SET name = $1 WHERE id = $2", "carol", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := result.RowsAffected(); n != 3 {
+		t.Errorf("Expected 3 rows affected, got %d", n)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT broken", Response{Error: "relation does not exist"})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	if _, err := db.Exec("SELECT broken"); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		t.Errorf("The connection should still be usable after an error, got %v", err)
+	}
+}
+
+func TestDelayWithinReadTimeout(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT 1", Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, Delay: 20 * time.Millisecond})
+
+	db := open(t, srv, "read_timeout=500")
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expected 1, got %d, %v", n, err)
+	}
+}
+
+func TestHangMidResult(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT n FROM big", Response{Columns: []string{"n"}, Rows: [][]string{{"1"}, {"2"}}, Hang: true})
+
+	db := open(t, srv, "read_timeout=100")
+	defer db.Close()
+
+	start := time.Now()
+	rows, err := db.Query("SELECT n FROM big")
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	if !isTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("The read timeout should have fired after 100ms, took %v", elapsed)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT 1", Response{Disconnect: true})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	if _, err := db.Exec("SELECT 1"); err == nil {
+		t.Error("Expected an error when the server disconnects")
+	}
+}
+
+func TestStartupHang(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SetStartup(Startup{Hang: true})
+
+	db := open(t, srv, "auth_timeout=100")
+	defer db.Close()
+
+	err := db.Ping()
+	var timeoutErr *pqtimeouts.TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Phase != pqtimeouts.PhaseAuth {
+		t.Errorf("Expected an auth timeout, got %v", err)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SetStartup(Startup{Password: "secret"})
+
+	db := open(t, srv, "password=wrong read_timeout=1000")
+	if err := db.Ping(); err == nil {
+		t.Error("Expected a wrong password to fail")
+	}
+	db.Close()
+
+	db = open(t, srv, "password=secret read_timeout=1000")
+	if err := db.Ping(); err != nil {
+		t.Errorf("Expected the right password to succeed, got %v", err)
+	}
+	db.Close()
+}
+
+func TestQueries(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	db := open(t, srv, "")
+	defer db.Close()
+	db.Exec("SET search_path = app")
+	db.Exec("SELECT $1::int", 1)
+
+	queries := srv.Queries()
+	if len(queries) != 2 || queries[0] != "SET search_path = app" || queries[1] != "SELECT $1::int" {
+		t.Errorf("Queries were not as expected: %q", queries)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("UPDATE broken", Response{Error: "relation does not exist"})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE users SET name = 'bob'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Expected the transaction to commit, got %v", err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE broken"); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, err := tx.Exec("UPDATE users SET name = 'bob'"); err == nil {
+		t.Error("Expected an error in a failed transaction")
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("Expected committing a failed transaction to fail")
+	}
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		t.Errorf("The connection should be usable after the transaction, got %v", err)
+	}
+}
+
+func TestCopyIn(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle(`COPY "users" ("name") FROM STDIN`, Response{CopyIn: true})
+
+	db := open(t, srv, "read_timeout=1000")
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.Prepare(`COPY "users" ("name") FROM STDIN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := stmt.Exec(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if copied := srv.Copied(); len(copied) != 2 || copied[0] != "alice" || copied[1] != "bob" {
+		t.Errorf("COPY data was not as expected: %q", copied)
+	}
+}
+
+func TestCopyOut(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Handle("COPY users TO STDOUT", Response{CopyOut: []string{"alice", "bob"}})
+
+	// lib/pq doesn't support COPY TO, so speak the protocol directly.
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	startup := append(uint32Bytes(protocolVersion3), "user\x00pqtest\x00\x00"...)
+	c.Write(append(uint32Bytes(uint32(len(startup)+4)), startup...))
+	for typ := byte(0); typ != 'Z'; {
+		if typ, _, err = readMessage(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := "COPY users TO STDOUT\x00"
+	c.Write(append(append([]byte{'Q'}, uint32Bytes(uint32(len(query)+4))...), query...))
+	var types, data string
+	for typ := byte(0); typ != 'Z'; {
+		var body []byte
+		if typ, body, err = readMessage(r); err != nil {
+			t.Fatal(err)
+		}
+		types += string(typ)
+		if typ == 'd' {
+			data += string(body)
+		}
+	}
+	if types != "HddcCZ" || data != "alice\nbob\n" {
+		t.Errorf("The response was not as expected: %q with data %q", types, data)
+	}
+}
+
+// readMessage reads a typed message sent by the server.
+func readMessage(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	_, err := io.ReadFull(r, body)
+	return header[0], body, err
+}
@@ -0,0 +1,363 @@
+package pqtimeouts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// ConnState is the protocol state of a connection as seen by pq-timeouts.
+type ConnState int
+
+const (
+	StateUnknown           ConnState = iota // Protocol tracking is off or the connection is encrypted
+	StateStartup                            // The startup message has been sent
+	StateAuth                               // The server has asked the client to authenticate
+	StateIdle                               // Ready for a query outside a transaction
+	StateIdleInTransaction                  // Ready for a query inside a transaction, which may have failed
+	StateQuery                              // A query is in progress
+	StateCopyIn                             // The client is sending COPY data
+	StateCopyOut                            // The server is sending COPY data
+	StateNotificationWait                   // Idle and waiting for the server to send a notification
+)
+
+var stateNames = []string{
+	"unknown", "startup", "auth", "idle", "idle in transaction", "query", "copy in", "copy out", "notification wait"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "invalid"
+	}
+	return stateNames[s]
+}
+
+// Protocol codes of the untyped messages a client can send first.
+const (
+	protocolVersion3 = 196608
+	sslRequestCode   = 80877103
+	gssEncRequest    = 80877104
+)
+
+// protocolTracker follows the Postgres frontend/backend protocol as it passes through a timeoutConn. It only sees
+// plaintext, so once the server agrees to TLS the state is unknown for the rest of the connection. It is locked, as
+// lib/pq reads the connection from another goroutine while it writes COPY data.
+type protocolTracker struct {
+	mu         sync.Mutex
+	state      ConnState
+	phase      Phase
+	phaseStart time.Time // When phase last changed
+	ssl        sslPhase
+	ready      int // The number of ReadyForQuery messages seen
+	backendPID int
+
+	frontend messageScanner
+	backend  messageScanner
+
+	// The query in progress, and when it was sent and its response started to arrive.
+	query      string
+	queryStart time.Time
+	firstByte  time.Time
+	statements map[string]string // The text of prepared statements by name
+	queryDone  func(query string, start, firstByte, end time.Time)
+}
+
+func newProtocolTracker() *protocolTracker {
+	return &protocolTracker{frontend: messageScanner{untyped: true}}
+}
+
+// trackedIO is what the tracker had seen around one read or write: the SSL phase before and after it, and the number
+// of ReadyForQuery messages after it.
+type trackedIO struct {
+	prev, ssl sslPhase
+	ready     int
+}
+
+// currentState returns the protocol state.
+func (p *protocolTracker) currentState() ConnState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// currentPhase returns the phase and when it started.
+func (p *protocolTracker) currentPhase() (Phase, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase, p.phaseStart
+}
+
+// currentSSL returns the SSL phase.
+func (p *protocolTracker) currentSSL() sslPhase {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ssl
+}
+
+// currentBackendPID returns the process ID of the backend, or 0 if the server hasn't sent it.
+func (p *protocolTracker) currentBackendPID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backendPID
+}
+
+// setState changes the state. The caller holds p.mu, as for all the methods below that don't lock it themselves.
+func (p *protocolTracker) setState(state ConnState) {
+	p.state = state
+	if phase := phaseOf(state); phase != p.phase {
+		p.phase = phase
+		p.phaseStart = time.Now()
+	}
+}
+
+// wrote follows the bytes written to the server.
+func (p *protocolTracker) wrote(b []byte) trackedIO {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	step := trackedIO{prev: p.ssl}
+	switch p.ssl {
+	case sslRequested:
+	case sslHandshake:
+		// The first application data record the client sends marks the end of its handshake.
+		if len(b) > 0 && b[0] == tlsApplicationData {
+			p.ssl = sslDone
+		}
+	case sslDone:
+	default:
+		p.frontend.scan(b, p.frontendMessage)
+	}
+	step.ssl, step.ready = p.ssl, p.ready
+	return step
+}
+
+// streaming reports whether the response to a query has started to arrive and more of it is expected.
+func (p *protocolTracker) streaming() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return (p.state == StateQuery && !p.firstByte.IsZero()) || p.state == StateCopyOut
+}
+
+// awaitingResponse reports whether the server owes the client a response, rather than the connection being idle.
+func (p *protocolTracker) awaitingResponse() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state {
+	case StateIdle, StateIdleInTransaction, StateNotificationWait:
+		return false
+	}
+	return true
+}
+
+// readStarted is called before reading from the server.
+func (p *protocolTracker) readStarted() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == StateIdle {
+		p.setState(StateNotificationWait)
+	}
+}
+
+// read follows the bytes read from the server.
+func (p *protocolTracker) read(b []byte) trackedIO {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	step := trackedIO{prev: p.ssl}
+	p.scanBackend(b)
+	step.ssl, step.ready = p.ssl, p.ready
+	return step
+}
+
+func (p *protocolTracker) scanBackend(b []byte) {
+	switch p.ssl {
+	case sslRequested:
+		// The server answers an SSLRequest with a single byte rather than a message.
+		if len(b) == 0 {
+			return
+		}
+		if b[0] == 'S' {
+			p.ssl = sslHandshake
+			p.setState(StateUnknown)
+			return
+		}
+		p.ssl = sslNone
+		b = b[1:]
+	case sslHandshake, sslDone:
+		return
+	}
+	if len(b) > 0 && !p.queryStart.IsZero() && p.firstByte.IsZero() {
+		p.firstByte = time.Now()
+	}
+	p.backend.scan(b, p.backendMessage)
+	if p.state == StateNotificationWait {
+		p.setState(StateIdle)
+	}
+}
+
+func (p *protocolTracker) frontendMessage(typ byte, body []byte) {
+	if p.frontend.untyped {
+		if len(body) < 4 {
+			return
+		}
+		switch binary.BigEndian.Uint32(body) {
+		case sslRequestCode, gssEncRequest:
+			p.ssl = sslRequested
+		case protocolVersion3:
+			p.frontend.untyped = false
+			p.setState(StateStartup)
+		}
+		return
+	}
+
+	switch typ {
+	case 'Q', 'P', 'B', 'E', 'D', 'C', 'S', 'H', 'F':
+		if p.state != StateCopyIn {
+			p.setState(StateQuery)
+		}
+		p.frontendQuery(typ, body)
+	case 'c', 'f': // CopyDone, CopyFail
+		p.setState(StateQuery)
+	case 'X': // Terminate
+		p.setState(StateUnknown)
+	}
+}
+
+// maxStatements is the most prepared statement texts a protocolTracker remembers.
+const maxStatements = 256
+
+// frontendQuery records the text and start of the query a frontend message belongs to.
+func (p *protocolTracker) frontendQuery(typ byte, body []byte) {
+	if p.queryStart.IsZero() {
+		p.queryStart = time.Now()
+	}
+	switch typ {
+	case 'Q':
+		p.query, _ = cString(body)
+	case 'P':
+		name, rest := cString(body)
+		p.query, _ = cString(rest)
+		if name != "" {
+			if p.statements == nil {
+				p.statements = make(map[string]string)
+			}
+			if len(p.statements) < maxStatements {
+				p.statements[name] = p.query
+			}
+		}
+	case 'B':
+		// Bind names the portal and then the prepared statement.
+		_, rest := cString(body)
+		if name, _ := cString(rest); name != "" {
+			p.query = p.statements[name]
+		}
+	case 'C':
+		// Closing a prepared statement forgets its text.
+		if len(body) > 0 && body[0] == 'S' {
+			name, _ := cString(body[1:])
+			delete(p.statements, name)
+		}
+	}
+}
+
+// cString returns the null terminated string at the start of b and the bytes after it.
+func cString(b []byte) (string, []byte) {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i]), b[i+1:]
+	}
+	return string(b), nil
+}
+
+func (p *protocolTracker) backendMessage(typ byte, body []byte) {
+	switch typ {
+	case 'R': // Authentication request
+		if len(body) >= 4 && binary.BigEndian.Uint32(body) != 0 {
+			p.setState(StateAuth)
+		}
+	case 'K': // BackendKeyData
+		if len(body) >= 4 {
+			p.backendPID = int(binary.BigEndian.Uint32(body))
+		}
+	case 'Z': // ReadyForQuery
+		p.ready++
+		if !p.queryStart.IsZero() {
+			if p.queryDone != nil {
+				p.queryDone(p.query, p.queryStart, p.firstByte, time.Now())
+			}
+			p.query = ""
+			p.queryStart = time.Time{}
+			p.firstByte = time.Time{}
+		}
+		if len(body) > 0 && body[0] != 'I' {
+			p.setState(StateIdleInTransaction)
+		} else {
+			p.setState(StateIdle)
+		}
+	case 'G': // CopyInResponse
+		p.setState(StateCopyIn)
+	case 'H', 'W': // CopyOutResponse, CopyBothResponse
+		p.setState(StateCopyOut)
+	case 'c': // CopyDone
+		if p.state == StateCopyOut {
+			p.setState(StateQuery)
+		}
+	}
+}
+
+// maxScannedBody is the most of a message body a messageScanner keeps. Longer bodies, such as large data rows, are
+// passed on truncated since nothing looks past their first few bytes.
+const maxScannedBody = 64 * 1024
+
+// messageScanner splits a stream of Postgres protocol messages, which may arrive in arbitrary pieces, into whole
+// messages. Untyped messages, such as the startup message, have no type byte.
+type messageScanner struct {
+	untyped   bool
+	header    [5]byte
+	headerLen int
+	remaining int // Body bytes still to come for the current message
+	body      []byte
+}
+
+// scan feeds b through the scanner, calling fn with the type and (possibly truncated) body of each message completed.
+// The type of an untyped message is 0.
+func (s *messageScanner) scan(b []byte, fn func(typ byte, body []byte)) {
+	for len(b) > 0 {
+		header := s.header[:]
+		if s.untyped {
+			header = s.header[1:]
+		}
+		if s.headerLen < len(header) {
+			n := copy(header[s.headerLen:], b)
+			s.headerLen += n
+			b = b[n:]
+			if s.headerLen < len(header) {
+				return
+			}
+			s.remaining = int(binary.BigEndian.Uint32(header[len(header)-4:])) - 4
+			if s.remaining < 0 {
+				s.remaining = 0
+			}
+			s.body = s.body[:0]
+		}
+
+		n := s.remaining
+		if n > len(b) {
+			n = len(b)
+		}
+		if keep := maxScannedBody - len(s.body); keep > 0 {
+			if keep > n {
+				keep = n
+			}
+			s.body = append(s.body, b[:keep]...)
+		}
+		s.remaining -= n
+		b = b[n:]
+
+		if s.remaining == 0 {
+			s.headerLen = 0
+			typ := s.header[0]
+			if s.untyped {
+				typ = 0
+			}
+			fn(typ, s.body)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package pqtimeouts
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+	"github.com/lib/pq"
+)
+
+// startupMessage builds the untyped message a client sends to start a session.
+func startupMessage(code uint32, params string) []byte {
+	b := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(b, uint32(8+len(params)))
+	binary.BigEndian.PutUint32(b[4:], code)
+	return append(b, params...)
+}
+
+func authMessage(code uint32) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, code)
+	return backendMessage('R', string(body))
+}
+
+func TestMessageScannerSplitsPieces(t *testing.T) {
+	var types []byte
+	var bodies []string
+	scanner := messageScanner{}
+
+	stream := append(backendMessage('1', ""), backendMessage('C', "SELECT 1\x00")...)
+	stream = append(stream, backendMessage('Z', "I")...)
+	for i := range stream {
+		scanner.scan(stream[i:i+1], func(typ byte, body []byte) {
+			types = append(types, typ)
+			bodies = append(bodies, string(body))
+		})
+	}
+
+	if string(types) != "1CZ" {
+		t.Errorf("Message types were not as expected: %q", types)
+	}
+
+	if bodies[1] != "SELECT 1\x00" || bodies[2] != "I" {
+		t.Errorf("Message bodies were not as expected: %q", bodies)
+	}
+}
+
+func TestProtocolTrackerSession(t *testing.T) {
+	p := newProtocolTracker()
+
+	if p.state != StateUnknown {
+		t.Errorf("Initial state was not as expected: %v", p.state)
+	}
+
+	p.wrote(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	if p.state != StateStartup {
+		t.Errorf("State after startup was not as expected: %v", p.state)
+	}
+
+	p.read(authMessage(5))
+	if p.state != StateAuth {
+		t.Errorf("State after auth request was not as expected: %v", p.state)
+	}
+
+	p.wrote(backendMessage('p', "md5abc\x00"))
+	p.read(append(authMessage(0), backendMessage('Z', "I")...))
+	if p.state != StateIdle {
+		t.Errorf("State after ReadyForQuery was not as expected: %v", p.state)
+	}
+
+	p.readStarted()
+	if p.state != StateNotificationWait {
+		t.Errorf("State while waiting for notifications was not as expected: %v", p.state)
+	}
+	p.read(backendMessage('A', "\x00\x00\x00\x01chan\x00\x00"))
+	if p.state != StateIdle {
+		t.Errorf("State after a notification was not as expected: %v", p.state)
+	}
+
+	p.wrote(backendMessage('Q', "BEGIN\x00"))
+	if p.state != StateQuery {
+		t.Errorf("State after a query was not as expected: %v", p.state)
+	}
+
+	p.readStarted()
+	p.read(append(backendMessage('C', "BEGIN\x00"), backendMessage('Z', "T")...))
+	if p.state != StateIdleInTransaction {
+		t.Errorf("State in a transaction was not as expected: %v", p.state)
+	}
+
+	p.wrote(backendMessage('Q', "COPY t FROM STDIN\x00"))
+	p.read(backendMessage('G', "\x00\x00\x00"))
+	if p.state != StateCopyIn {
+		t.Errorf("State during COPY FROM was not as expected: %v", p.state)
+	}
+
+	p.wrote(backendMessage('d', "1\t2\n"))
+	if p.state != StateCopyIn {
+		t.Errorf("State while sending COPY data was not as expected: %v", p.state)
+	}
+
+	p.wrote(backendMessage('c', ""))
+	if p.state != StateQuery {
+		t.Errorf("State after CopyDone was not as expected: %v", p.state)
+	}
+
+	p.read(append(backendMessage('C', "COPY 1\x00"), backendMessage('Z', "T")...))
+	p.wrote(backendMessage('Q', "COPY t TO STDOUT\x00"))
+	p.read(append(backendMessage('H', "\x00\x00\x00"), backendMessage('d', "1\t2\n")...))
+	if p.state != StateCopyOut {
+		t.Errorf("State during COPY TO was not as expected: %v", p.state)
+	}
+
+	p.read(backendMessage('c', ""))
+	if p.state != StateQuery {
+		t.Errorf("State after the server's CopyDone was not as expected: %v", p.state)
+	}
+
+	if p.ready != 3 {
+		t.Errorf("ReadyForQuery count was not as expected: %d", p.ready)
+	}
+}
+
+func TestProtocolTrackerTLS(t *testing.T) {
+	p := newProtocolTracker()
+
+	p.wrote(startupMessage(sslRequestCode, ""))
+	p.read([]byte{'S'})
+
+	if p.state != StateUnknown || p.ssl != sslHandshake {
+		t.Errorf("State after TLS was accepted was not as expected: %v", p.state)
+	}
+
+	p.wrote([]byte{tlsApplicationData, 3, 3})
+	p.read(backendMessage('Z', "I"))
+
+	if p.state != StateUnknown || p.ssl != sslDone || p.ready != 0 {
+		t.Errorf("Encrypted traffic should not be tracked: %v", p.state)
+	}
+}
+
+func TestProtocolTrackerTLSRefused(t *testing.T) {
+	p := newProtocolTracker()
+
+	p.wrote(startupMessage(sslRequestCode, ""))
+	p.read([]byte{'N'})
+	p.wrote(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	p.read(append(authMessage(0), backendMessage('Z', "I")...))
+
+	if p.state != StateIdle || p.ssl != sslNone {
+		t.Errorf("State after TLS was refused was not as expected: %v", p.state)
+	}
+}
+
+func TestConnState(t *testing.T) {
+	conn := &timeoutConn{conn: &testNetConn{}}
+
+	if conn.State() != StateUnknown {
+		t.Errorf("State without tracking was not as expected: %v", conn.State())
+	}
+
+	conn = &timeoutConn{conn: &testDataConn{}, protocol: newProtocolTracker()}
+	conn.Write(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+
+	if conn.State() != StateStartup || conn.State().String() != "startup" {
+		t.Errorf("State was not as expected: %v", conn.State())
+	}
+}
+
+// testCopyIn runs COPY FROM STDIN through a fake server with the settings given, and checks every row arrives. lib/pq
+// reads the connection from another goroutine while it writes the rows, so it finds races when run with -race.
+func testCopyIn(t *testing.T, settings string, configure func(*Config)) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle(`COPY "users" ("name") FROM STDIN`, pqtimeoutstest.Response{CopyIn: true})
+
+	cfg, err := ParseConfig(srv.ConnString() + " " + settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	db := sql.OpenDB(NewConnector(cfg))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("users", "name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := stmt.Exec(fmt.Sprintf("user%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if copied := srv.Copied(); len(copied) != 1000 || copied[999] != "user999" {
+		t.Errorf("Expected 1000 rows to be copied, got %d", len(copied))
+	}
+}
+
+func TestProtocolTrackerCopyIn(t *testing.T) {
+	testCopyIn(t, "query_timeout=5000 copy_timeout=5000", nil)
+}
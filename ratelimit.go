@@ -0,0 +1,109 @@
+package pqtimeouts
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest burst a RateLimiter allows by default, so slow limits don't split I/O into tiny pieces.
+const minBurst = 512
+
+// RateLimiter is a token bucket limiting the bytes per second read or written. It is safe for concurrent use, so one
+// limiter can be shared by many connections.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second, or 0 for no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+	sleep  func(time.Duration) // Allow this to be stubbed for testing
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond, in bursts of up to burst bytes. A burst of 0 allows a
+// tenth of a second's worth.
+func NewRateLimiter(bytesPerSecond float64, burst int) *RateLimiter {
+	r := &RateLimiter{sleep: time.Sleep}
+	r.SetRate(bytesPerSecond, burst)
+	r.tokens = r.burst
+	return r
+}
+
+// SetRate changes the limit. A rate of 0 removes it.
+func (r *RateLimiter) SetRate(bytesPerSecond float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rate = bytesPerSecond
+	r.burst = float64(burst)
+	if burst <= 0 {
+		r.burst = math.Max(bytesPerSecond/10, minBurst)
+	}
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+}
+
+// wait blocks until n bytes, or a whole burst if n is larger, may be transferred, then takes and returns them.
+func (r *RateLimiter) wait(n int) int {
+	for {
+		r.mu.Lock()
+		if r.rate <= 0 {
+			r.mu.Unlock()
+			return n
+		}
+
+		now := time.Now()
+		if !r.last.IsZero() {
+			r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+		}
+		r.last = now
+
+		need := math.Min(float64(n), math.Floor(r.burst))
+		if r.tokens >= need {
+			r.tokens -= need
+			r.mu.Unlock()
+			return int(need)
+		}
+		delay := time.Duration((need - r.tokens) / r.rate * float64(time.Second))
+		r.mu.Unlock()
+		r.sleep(delay)
+	}
+}
+
+// refund returns n bytes taken by wait but not transferred.
+func (r *RateLimiter) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	if r.rate > 0 {
+		r.tokens = math.Min(r.burst, r.tokens+float64(n))
+	}
+	r.mu.Unlock()
+}
+
+// rateLimiters are the limiters a connection waits on before each read or write, such as its own and its pool's.
+type rateLimiters []*RateLimiter
+
+// wait blocks until every limiter allows some bytes, returning how many up to n may be transferred.
+func (l rateLimiters) wait(n int) int {
+	allowed := n
+	for i, limiter := range l {
+		granted := limiter.wait(allowed)
+		if granted < allowed {
+			// Give back what the earlier limiters granted beyond this one.
+			for _, earlier := range l[:i] {
+				earlier.refund(allowed - granted)
+			}
+			allowed = granted
+		}
+	}
+	return allowed
+}
+
+func (l rateLimiters) refund(n int) {
+	for _, limiter := range l {
+		limiter.refund(n)
+	}
+}
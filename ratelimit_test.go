@@ -0,0 +1,123 @@
+package pqtimeouts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := NewRateLimiter(1000, 100)
+	var slept time.Duration
+	limiter.sleep = func(d time.Duration) { slept += d; time.Sleep(d) }
+
+	if granted := limiter.wait(250); granted != 100 {
+		t.Errorf("The first wait should be granted the burst: %d", granted)
+	}
+
+	start := time.Now()
+	if granted := limiter.wait(250); granted != 100 {
+		t.Errorf("The second wait should be granted another burst: %d", granted)
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("The second burst should take a tenth of a second to refill: %v", elapsed)
+	}
+
+	if slept == 0 {
+		t.Error("The limiter should have waited for tokens")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(0, 0)
+	limiter.sleep = func(d time.Duration) { t.Error("An unlimited limiter should not wait") }
+
+	if granted := limiter.wait(1 << 20); granted != 1<<20 {
+		t.Errorf("An unlimited limiter should grant everything: %d", granted)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := NewRateLimiter(0, 0)
+	limiter.SetRate(1000, 0)
+
+	if limiter.burst != minBurst {
+		t.Errorf("The default burst should not be below the minimum: %v", limiter.burst)
+	}
+
+	limiter.SetRate(1e6, 0)
+	if limiter.burst != 1e5 {
+		t.Errorf("The default burst should be a tenth of a second: %v", limiter.burst)
+	}
+}
+
+func TestRateLimitersRefund(t *testing.T) {
+	conn := NewRateLimiter(1000, 1000)
+	pool := NewRateLimiter(1000, 100)
+
+	if granted := (rateLimiters{conn, pool}).wait(500); granted != 100 {
+		t.Errorf("The smallest grant should win: %d", granted)
+	}
+
+	if conn.tokens < 899 || conn.tokens > 901 {
+		t.Errorf("The connection limiter should only lose what was granted: %v", conn.tokens)
+	}
+}
+
+func TestWriteRateLimited(t *testing.T) {
+	testConn := &testDataConn{}
+	conn := &timeoutConn{
+		conn:          testConn,
+		writeTimeout:  50 * time.Millisecond,
+		writeLimiters: rateLimiters{NewRateLimiter(100000, 1000)}}
+
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 3000))
+
+	if n != 3000 || err != nil {
+		t.Errorf("The write was not as expected: %d, %v", n, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("The write should have been limited: %v", elapsed)
+	}
+
+	if testConn.writeCalled != 3 {
+		t.Errorf("The write should have been split into bursts: %d", testConn.writeCalled)
+	}
+
+	// The last deadline was set after waiting on the limiter, not from the start of Write.
+	if deadline := testConn.setWriteDeadlineTimePrev; deadline.Sub(start) < 60*time.Millisecond {
+		t.Errorf("Waiting on the limiter should not count against the write timeout: %v", deadline.Sub(start))
+	}
+}
+
+func TestReadRateLimited(t *testing.T) {
+	testConn := &testDataConn{reads: [][]byte{make([]byte, 4096)}}
+	limiter := NewRateLimiter(1000, 100)
+	conn := &timeoutConn{conn: testConn, readLimiters: rateLimiters{limiter}}
+
+	n, _ := conn.Read(make([]byte, 4096))
+
+	if n != 100 {
+		t.Errorf("The read should have been limited to the burst: %d", n)
+	}
+}
+
+func TestParseConfigRateLimits(t *testing.T) {
+	cfg, err := ParseConfig("dbname=pqtest read_rate_limit=1000 write_rate_limit=2000 pool_read_rate_limit=3000 pool_write_rate_limit=4000")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if cfg.ReadRateLimit != 1000 || cfg.WriteRateLimit != 2000 || cfg.PoolReadRateLimit != 3000 || cfg.PoolWriteRateLimit != 4000 {
+		t.Errorf("Rate limits were not as expected: %+v", cfg)
+	}
+
+	connector := NewConnector(cfg)
+	dialer := connector.dialer()
+	if dialer.poolReadLimiter != connector.readLimiter || connector.readLimiter == nil || connector.writeLimiter == nil {
+		t.Error("The pool limiters should be shared through the dialer")
+	}
+}
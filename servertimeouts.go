@@ -0,0 +1,65 @@
+package pqtimeouts
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultServerTimeoutMargin is how much sooner than the client the server gives up, when server timeouts are derived.
+const DefaultServerTimeoutMargin = 100 * time.Millisecond
+
+// withServerTimeouts returns the connection string of cfg with the server timeouts derived from its client timeouts
+// added to options. Server timeouts already in the connection string are kept.
+func withServerTimeouts(cfg Config) (string, error) {
+	if !cfg.ServerStatementTimeout && !cfg.ServerLockTimeout && !cfg.ServerIdleInTransactionTimeout {
+		return cfg.ConnString, nil
+	}
+	settings, err := splitSettings(cfg.ConnString)
+	if err != nil {
+		return "", err
+	}
+
+	margin := cfg.ServerTimeoutMargin
+	if margin == 0 {
+		margin = DefaultServerTimeoutMargin
+	}
+	statement := cfg.QueryTimeout
+	if statement == 0 {
+		statement = cfg.ReadTimeout
+	}
+
+	var options []string
+	add := func(name string, enabled bool, timeout time.Duration) {
+		if _, _, given := serverSetting(settings, name); !enabled || timeout == 0 || given {
+			return
+		}
+		options = append(options, "-c "+name+"="+serverTimeout(timeout, margin))
+	}
+	add("statement_timeout", cfg.ServerStatementTimeout, statement)
+	add("lock_timeout", cfg.ServerLockTimeout, statement)
+	add("idle_in_transaction_session_timeout", cfg.ServerIdleInTransactionTimeout, cfg.IdleInTransactionTimeout)
+	if len(options) == 0 {
+		return cfg.ConnString, nil
+	}
+
+	if settings["options"] != "" {
+		options = append([]string{settings["options"]}, options...)
+	}
+	// lib/pq uses the last value given for a setting, so this replaces any options already given.
+	value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(strings.Join(options, " "))
+	return strings.TrimSpace(cfg.ConnString + " options='" + value + "'"), nil
+}
+
+// serverTimeout formats timeout less margin for the server, in milliseconds. The margin is at most half the timeout,
+// so a short timeout is not lost.
+func serverTimeout(timeout, margin time.Duration) string {
+	if margin > timeout/2 {
+		margin = timeout / 2
+	}
+	ms := (timeout - margin).Milliseconds()
+	if ms < 1 {
+		ms = 1 // 0 turns the server timeout off
+	}
+	return strconv.FormatInt(ms, 10) + "ms"
+}
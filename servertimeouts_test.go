@@ -0,0 +1,91 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+	"github.com/lib/pq"
+)
+
+func TestWithServerTimeouts(t *testing.T) {
+	for _, test := range []struct {
+		dsn      string
+		expected string
+	}{
+		{"user=pqtest read_timeout=1000", "user=pqtest"},
+		{"user=pqtest read_timeout=1000 server_statement_timeout=true",
+			"user=pqtest options='-c statement_timeout=900ms'"},
+		{"user=pqtest read_timeout=1000 query_timeout=5000 server_statement_timeout=true server_lock_timeout=true " +
+			"server_timeout_margin=1000",
+			"user=pqtest options='-c statement_timeout=4000ms -c lock_timeout=4000ms'"},
+		{"user=pqtest read_timeout=100 server_statement_timeout=true",
+			"user=pqtest options='-c statement_timeout=50ms'"},
+		{"user=pqtest idle_in_transaction_timeout=30000 server_idle_in_transaction_timeout=true",
+			"user=pqtest options='-c idle_in_transaction_session_timeout=29900ms'"},
+		{"user=pqtest options='-c search_path=app' read_timeout=1000 server_statement_timeout=true",
+			"user=pqtest options='-c search_path=app' options='-c search_path=app -c statement_timeout=900ms'"},
+		{"user=pqtest statement_timeout=5000 read_timeout=1000 server_statement_timeout=true",
+			"user=pqtest statement_timeout=5000"},
+		{"user=pqtest server_statement_timeout=true", "user=pqtest"},
+	} {
+		cfg, err := ParseConfig(test.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		connString, err := withServerTimeouts(cfg)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.dsn, err)
+		}
+		if connString != test.expected {
+			t.Errorf("The connection string for %q was not as expected: %q", test.dsn, connString)
+		}
+	}
+}
+
+func TestConnectorServerTimeouts(t *testing.T) {
+	var connection string
+	connector := NewConnector(Config{ConnString: "dbname=pqtest", ReadTimeout: 2 * time.Second,
+		ServerStatementTimeout: true})
+	connector.dialOpen = func(d pq.Dialer, name string) (driver.Conn, error) {
+		connection = name
+		return nil, nil
+	}
+
+	if _, err := connector.Connect(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if connection != "dbname=pqtest options='-c statement_timeout=1900ms'" {
+		t.Errorf("The connection string was not as expected: %q", connection)
+	}
+}
+
+func TestServerStatementTimeoutWithLongerReadTimeout(t *testing.T) {
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.Handle("SELECT report()", pqtimeoutstest.Response{Columns: []string{"report"}, Rows: [][]string{{"ok"}},
+		Delay: 300 * time.Millisecond})
+
+	db, err := sql.Open("pq-timeouts", srv.ConnString()+" read_timeout=100 server_statement_timeout=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The statement_timeout sent when connecting still applies, so the server cancels the statement even though the
+	// client would wait for it.
+	var report string
+	ctx := WithReadTimeout(context.Background(), time.Second)
+	err = db.QueryRowContext(ctx, "SELECT report()").Scan(&report)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "57014" {
+		t.Errorf("Expected the server to cancel the statement, got %v", err)
+	}
+	if isTimeout(err) {
+		t.Errorf("The client should not have timed out: %v", err)
+	}
+}
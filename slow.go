@@ -0,0 +1,118 @@
+package pqtimeouts
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// SlowQuery describes a query that took at least the slow_threshold.
+type SlowQuery struct {
+	SQL       string        // The text of the query, redacted if slow_query_redact is set
+	Host      string        // The host the query was sent to
+	FirstByte time.Duration // From sending the query to the first byte of the response
+	Duration  time.Duration // From sending the query until the server was ready for the next one
+}
+
+// SlowQueryHandler is called with each query that takes at least the slow_threshold. It is called from the goroutine
+// reading the response, so it should not block.
+type SlowQueryHandler func(SlowQuery)
+
+// slowQueries reports the queries on a connection that take at least threshold.
+type slowQueries struct {
+	threshold time.Duration
+	redact    bool
+	handler   SlowQueryHandler
+	logger    eventLogger
+	host      string
+}
+
+func (s *slowQueries) queryDone(query string, start, firstByte, end time.Time) {
+	duration := end.Sub(start)
+	if duration < s.threshold {
+		return
+	}
+
+	slow := SlowQuery{SQL: query, Host: s.host, Duration: duration}
+	if !firstByte.IsZero() {
+		slow.FirstByte = firstByte.Sub(start)
+	}
+	if s.redact {
+		slow.SQL = redactSQL(slow.SQL)
+	}
+	if s.handler != nil {
+		s.handler(slow)
+	}
+	s.logger.log(slog.LevelWarn, "pqtimeouts: slow query", "host", slow.Host, "duration", slow.Duration,
+		"first_byte", slow.FirstByte, "sql", slow.SQL)
+}
+
+// redactSQL replaces the string and numeric literals in query with ?, leaving identifiers, keywords and placeholders
+// such as $1.
+func redactSQL(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'':
+			// A string literal, in which '' is an escaped quote. Backslash escapes only apply to E'' strings.
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i < 2 || !isIdentStart(query[i-2]))
+			i++
+			for i < len(query) {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				if escapes && query[i] == '\\' && i+1 < len(query) {
+					i++
+				}
+				i++
+			}
+			i++
+			b.WriteByte('?')
+		case c == '$' && i+1 < len(query) && (query[i+1] == '$' || isIdentStart(query[i+1])):
+			// A dollar quoted string such as $$text$$ or $tag$text$tag$.
+			end := strings.IndexByte(query[i+1:], '$')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			tag := query[i : i+end+2]
+			closing := strings.Index(query[i+len(tag):], tag)
+			if closing < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + closing + len(tag)
+			}
+			b.WriteByte('?')
+		case c == '$' || isIdentStart(c):
+			// Placeholders, identifiers and keywords are kept whole, including any digits in them.
+			start := i
+			i++
+			for i < len(query) && (isIdentStart(query[i]) || isDigit(query[i])) {
+				i++
+			}
+			b.WriteString(query[start:i])
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.' || query[i] == 'e' || query[i] == 'E') {
+				i++
+			}
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,93 @@
+package pqtimeouts
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedactSQL(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM users WHERE name = 'o''brien' AND age > 21": "SELECT * FROM users WHERE name = ? AND age > ?",
+		"SELECT col1, 1.5e3 FROM t2 WHERE id = $1":                 "SELECT col1, ? FROM t2 WHERE id = $1",
+		"SELECT $$secret$$, $tag$more $ secret$tag$ FROM t":        "SELECT ?, ? FROM t",
+		"INSERT INTO t (a, b) VALUES (E'line\\'s', 'C:\\', -.5)":   "INSERT INTO t (a, b) VALUES (E?, ?, -?)",
+	}
+
+	for query, expected := range tests {
+		if redacted := redactSQL(query); redacted != expected {
+			t.Errorf("Redacted %q was not as expected: %q", query, redacted)
+		}
+	}
+}
+
+func TestSlowQueryReported(t *testing.T) {
+	var reported []SlowQuery
+	response := append(backendMessage('C', "SELECT 1\x00"), backendMessage('Z', "I")...)
+	testConn := &testDataConn{reads: [][]byte{response}}
+
+	dialer := timeoutDialer{
+		netDial: func(network string, address string) (net.Conn, error) {
+			return testConn, nil
+		},
+		slowThreshold:     time.Millisecond,
+		redactSlowQueries: true,
+		slowQueryHandler:  func(slow SlowQuery) { reported = append(reported, slow) }}
+
+	conn, _ := dialer.Dial("tcp", "db1:5432")
+	tc := conn.(*timeoutConn)
+	tc.protocol.wrote(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	tc.protocol.read(backendMessage('Z', "I"))
+
+	conn.Write(backendMessage('P', "\x00SELECT pg_sleep(0.01) WHERE id = 7\x00\x00\x00"))
+	conn.Write(append(backendMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00"), backendMessage('S', "")...))
+	time.Sleep(5 * time.Millisecond)
+	conn.Read(make([]byte, 64))
+
+	if len(reported) != 1 {
+		t.Fatalf("Expected one slow query, got %d", len(reported))
+	}
+
+	slow := reported[0]
+	if slow.SQL != "SELECT pg_sleep(?) WHERE id = ?" {
+		t.Errorf("The SQL was not as expected: %q", slow.SQL)
+	}
+
+	if slow.Host != "db1" || slow.Duration < 5*time.Millisecond || slow.FirstByte > slow.Duration {
+		t.Errorf("The slow query was not as expected: %+v", slow)
+	}
+}
+
+func TestFastQueryNotReported(t *testing.T) {
+	called := false
+	slow := &slowQueries{threshold: time.Second, handler: func(SlowQuery) { called = true }}
+
+	start := time.Now()
+	slow.queryDone("SELECT 1", start, start, start.Add(time.Millisecond))
+
+	if called {
+		t.Error("A fast query should not be reported")
+	}
+}
+
+func TestPreparedStatementText(t *testing.T) {
+	p := newProtocolTracker()
+	var queries []string
+	p.queryDone = func(query string, start, firstByte, end time.Time) { queries = append(queries, query) }
+
+	p.wrote(startupMessage(protocolVersion3, "user\x00pqtest\x00\x00"))
+	p.read(backendMessage('Z', "I"))
+	p.wrote(backendMessage('P', "stmt1\x00SELECT $1\x00\x00\x00"))
+	p.wrote(backendMessage('S', ""))
+	p.read(backendMessage('Z', "I"))
+	p.wrote(backendMessage('Q', "SELECT 2\x00"))
+	p.read(backendMessage('Z', "I"))
+	p.wrote(backendMessage('B', "\x00stmt1\x00\x00\x00\x00\x00\x00\x00"))
+	p.wrote(backendMessage('E', "\x00\x00\x00\x00\x00"))
+	p.wrote(backendMessage('S', ""))
+	p.read(backendMessage('Z', "I"))
+
+	if len(queries) != 3 || queries[0] != "SELECT $1" || queries[1] != "SELECT 2" || queries[2] != "SELECT $1" {
+		t.Errorf("Queries were not as expected: %q", queries)
+	}
+}
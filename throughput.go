@@ -0,0 +1,92 @@
+package pqtimeouts
+
+import (
+	"time"
+)
+
+// Defaults for throughput monitoring.
+const (
+	DefaultThroughputWindow = 10 * time.Second
+	DefaultThroughputGrace  = 5 * time.Second
+
+	// throughputSlots is how many parts the window is split into, so it slides in steps of a tenth of its length.
+	throughputSlots = 10
+)
+
+type throughputSlot struct {
+	index int64 // Which step of the window this slot was last used for
+	bytes int64
+	busy  time.Duration
+}
+
+// throughputMonitor measures the rate a response is read at over a sliding window. The rate only counts the time spent
+// waiting in Read, so a slow consumer doesn't look like a slow network.
+type throughputMonitor struct {
+	min        float64 // Bytes per second
+	window     time.Duration
+	grace      time.Duration
+	slots      [throughputSlots]throughputSlot
+	belowSince time.Time
+}
+
+func newThroughputMonitor(min float64, window, grace time.Duration) *throughputMonitor {
+	if window <= 0 {
+		window = DefaultThroughputWindow
+	}
+	if grace <= 0 {
+		grace = DefaultThroughputGrace
+	}
+	return &throughputMonitor{min: min, window: window, grace: grace}
+}
+
+// deadline caps the deadline of a read starting at now, so a read that stalls for the whole grace period fails.
+func (m *throughputMonitor) deadline(now, deadline time.Time, phase Phase) (time.Time, Phase) {
+	stalled := now.Add(m.grace)
+	if deadline.IsZero() || stalled.Before(deadline) {
+		return stalled, PhaseThroughput
+	}
+	return deadline, phase
+}
+
+// observe records a read of n bytes that waited busy, returning false once the rate has been below the minimum for
+// longer than the grace period.
+func (m *throughputMonitor) observe(now time.Time, n int, busy time.Duration) bool {
+	step := m.window / throughputSlots
+	index := now.UnixNano() / int64(step)
+	slot := &m.slots[index%throughputSlots]
+	if slot.index != index {
+		*slot = throughputSlot{index: index}
+	}
+	slot.bytes += int64(n)
+	slot.busy += busy
+
+	if m.rate(index) >= m.min {
+		m.belowSince = time.Time{}
+		return true
+	}
+	if m.belowSince.IsZero() {
+		m.belowSince = now
+	}
+	return now.Sub(m.belowSince) <= m.grace
+}
+
+// rate returns the bytes per second read in the window ending with step index.
+func (m *throughputMonitor) rate(index int64) float64 {
+	var bytes int64
+	var busy time.Duration
+	for _, slot := range m.slots {
+		if index-slot.index < throughputSlots {
+			bytes += slot.bytes
+			busy += slot.busy
+		}
+	}
+	if busy <= 0 {
+		return m.min
+	}
+	return float64(bytes) / busy.Seconds()
+}
+
+// pause is called between responses, when no data is expected.
+func (m *throughputMonitor) pause() {
+	m.belowSince = time.Time{}
+}
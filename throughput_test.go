@@ -0,0 +1,110 @@
+package pqtimeouts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThroughputAboveMinimum(t *testing.T) {
+	m := newThroughputMonitor(1000, time.Second, time.Second)
+	now := time.Now()
+
+	for i := 0; i < 20; i++ {
+		if !m.observe(now.Add(time.Duration(i)*100*time.Millisecond), 200, 100*time.Millisecond) {
+			t.Fatal("2000 bytes per second should be above the minimum")
+		}
+	}
+}
+
+func TestThroughputBelowMinimumPastGrace(t *testing.T) {
+	m := newThroughputMonitor(1000, time.Second, 300*time.Millisecond)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !m.observe(now.Add(time.Duration(i)*100*time.Millisecond), 10, 100*time.Millisecond) {
+			t.Fatalf("Throughput should not fail within the grace period (read %d)", i)
+		}
+	}
+
+	if m.observe(now.Add(500*time.Millisecond), 10, 100*time.Millisecond) {
+		t.Error("Throughput should fail after the grace period")
+	}
+}
+
+func TestThroughputRecovers(t *testing.T) {
+	m := newThroughputMonitor(1000, time.Second, 300*time.Millisecond)
+	now := time.Now()
+
+	m.observe(now, 10, 100*time.Millisecond)
+	m.observe(now.Add(100*time.Millisecond), 100000, 100*time.Millisecond)
+
+	if !m.belowSince.IsZero() {
+		t.Error("Throughput above the minimum should reset the grace period")
+	}
+
+	m.observe(now.Add(5*time.Second), 10, 100*time.Millisecond)
+	m.pause()
+	if !m.belowSince.IsZero() {
+		t.Error("A pause between responses should reset the grace period")
+	}
+}
+
+func TestThroughputWindowSlides(t *testing.T) {
+	m := newThroughputMonitor(1000, time.Second, time.Second)
+	now := time.Now()
+
+	m.observe(now, 1, time.Second)
+	m.observe(now.Add(2*time.Second), 2000, time.Second)
+
+	index := now.Add(2*time.Second).UnixNano() / int64(100*time.Millisecond)
+	if rate := m.rate(index); rate != 2000 {
+		t.Errorf("Old reads should have left the window: %v", rate)
+	}
+}
+
+func TestThroughputStallDeadline(t *testing.T) {
+	testConn := &testDataConn{testNetConn: testNetConn{readError: testTimeoutError{}}}
+	conn := trackedConn(testConn, phaseTimeouts{})
+	conn.throughput = newThroughputMonitor(1000, time.Second, 200*time.Millisecond)
+	conn.readTimeout = time.Minute
+
+	conn.protocol.wrote(backendMessage('Q', "SELECT * FROM big\x00"))
+	conn.protocol.read(backendMessage('T', "\x00\x00"))
+
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 64))
+
+	if deadline := testConn.setReadDeadlineTimePrev; deadline.Sub(start) > 210*time.Millisecond {
+		t.Errorf("A streaming read should be bounded by the grace period: %v", deadline.Sub(start))
+	}
+
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Phase != PhaseThroughput ||
+		timeoutErr.Limit != 200*time.Millisecond {
+		t.Errorf("A throughput TimeoutError was expected: %v", err)
+	}
+}
+
+func TestThroughputNotMonitoredBeforeResponse(t *testing.T) {
+	testConn := &testNetConn{}
+	conn := trackedConn(testConn, phaseTimeouts{})
+	conn.throughput = newThroughputMonitor(1000, time.Second, 200*time.Millisecond)
+
+	conn.protocol.wrote(backendMessage('Q', "SELECT pg_sleep(60)\x00"))
+	conn.Read(make([]byte, 64))
+
+	if testConn.setReadDeadlineCalled != 0 {
+		t.Error("Waiting for the first byte of a response should not be bounded by the grace period")
+	}
+}
+
+func TestParseConfigThroughput(t *testing.T) {
+	cfg, err := ParseConfig("dbname=pqtest min_throughput=65536 throughput_window=30000 throughput_grace=10000")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if cfg.MinThroughput != 65536 || cfg.ThroughputWindow != 30*time.Second || cfg.ThroughputGrace != 10*time.Second {
+		t.Errorf("Throughput settings were not as expected: %+v", cfg)
+	}
+}
@@ -0,0 +1,254 @@
+package pqtimeouts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Attribute keys set on TLS spans when pq-timeouts negotiates TLS itself.
+const (
+	AttrTLSVersion = "pqtimeouts.tls_version"
+	AttrTLSCipher  = "pqtimeouts.tls_cipher"
+)
+
+// tlsSettings describes how pq-timeouts negotiates TLS itself, in place of lib/pq.
+type tlsSettings struct {
+	config      *tls.Config
+	provider    CertificateProvider // Supplies the certificates for each dial when set
+	verifyCA    bool                // Verify the server's certificate authority but not its host name
+	verifyRoots bool                // Verify the certificate authority when the provider supplies root certificates
+	required    bool                // Fail if the server refuses TLS, rather than continuing in plaintext
+	timeout     time.Duration       // For the SSLRequest and handshake together, or 0 to use the read timeout
+}
+
+// newTLSSettings returns how to negotiate TLS for cfg and the connection string to give lib/pq, which no longer
+// negotiates TLS itself. It returns nil settings when TLS is left to lib/pq, or turned off.
+func newTLSSettings(cfg Config) (*tlsSettings, string, error) {
+	if cfg.TLSConfig == nil && cfg.TLSHandshakeTimeout == 0 && cfg.CertificateProvider == nil {
+		return nil, cfg.ConnString, nil
+	}
+	settings, err := splitSettings(cfg.ConnString)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &tlsSettings{timeout: cfg.TLSHandshakeTimeout, provider: cfg.CertificateProvider}
+	switch mode := settings["sslmode"]; mode {
+	case "disable":
+		return nil, cfg.ConnString, nil
+	case "allow", "prefer":
+	case "", "require":
+		t.required = true
+		// As in lib/pq, require verifies the certificate authority when a root certificate is given, in sslrootcert or
+		// by the provider.
+		t.verifyCA = settings["sslrootcert"] != ""
+		t.verifyRoots = true
+	case "verify-ca":
+		t.required = true
+		t.verifyCA = true
+	case "verify-full":
+		t.required = true
+	default:
+		return nil, "", fmt.Errorf("pqtimeouts: unsupported sslmode %q", mode)
+	}
+
+	if cfg.TLSConfig != nil {
+		t.config = cfg.TLSConfig.Clone()
+		t.verifyCA = false
+		t.verifyRoots = false
+	} else {
+		t.config = tlsConfigFromSettings(settings)
+		if t.provider == nil && (settings["sslcert"] != "" || settings["sslkey"] != "" || settings["sslrootcert"] != "") {
+			// Read the files on each dial, so rotated certificates are picked up.
+			if t.provider, err = NewFileCertificates(
+				settings["sslcert"], settings["sslkey"], settings["sslrootcert"]); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if t.config.ServerName == "" && !t.config.InsecureSkipVerify {
+		t.config.ServerName = settings["host"]
+		if t.config.ServerName == "" {
+			t.config.ServerName = "localhost"
+		}
+	}
+	return t, withSetting(cfg.ConnString, "sslmode", "disable"), nil
+}
+
+// tlsConfigFromSettings builds a tls.Config from the sslmode of a connection string, as lib/pq would. Certificates
+// from sslcert, sslkey and sslrootcert are added on each dial by a FileCertificates. Unlike lib/pq, it doesn't look
+// for certificates in ~/.postgresql.
+func tlsConfigFromSettings(settings map[string]string) *tls.Config {
+	config := &tls.Config{}
+	if settings["sslmode"] != "verify-full" {
+		// Full verification would check the host name, so verify any certificate authority ourselves.
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// configFor returns the tls.Config for a new connection, with the certificates from the provider if there is one.
+func (t *tlsSettings) configFor(ctx context.Context) (*tls.Config, error) {
+	config := t.config.Clone()
+	verifyCA := t.verifyCA
+	if t.provider != nil {
+		certs, err := t.provider.Certificates(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(certs.Client) > 0 {
+			config.Certificates = certs.Client
+		}
+		if certs.RootCAs != nil {
+			config.RootCAs = certs.RootCAs
+			verifyCA = verifyCA || t.verifyRoots
+		}
+	}
+	if verifyCA {
+		config.VerifyConnection = verifyCertificateAuthority(config)
+	}
+	return config, nil
+}
+
+// verifyCertificateAuthority returns a check that the server's certificate chains to the root certificates of config,
+// or the system's when it has none, without checking its host name.
+func verifyCertificateAuthority(config *tls.Config) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("pqtimeouts: the server sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: config.RootCAs, Intermediates: x509.NewCertPool()}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// withSetting returns connString with key set to value. A connString that doesn't parse has the setting appended, and
+// lib/pq reports the error.
+func withSetting(connString, key, value string) string {
+	settings, err := ParseSettings(connString)
+	if err != nil {
+		return connString + " " + Setting{Key: key, Value: value}.String()
+	}
+	fields := make([]string, 0, len(settings)+1)
+	found := false
+	for _, setting := range settings {
+		if setting.Key == key {
+			setting.Value, found = value, true
+		}
+		fields = append(fields, setting.String())
+	}
+	if !found {
+		fields = append(fields, Setting{Key: key, Value: value}.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// startTLS sends an SSLRequest on a new connection and performs the TLS handshake if the server agrees. The whole
+// exchange is bounded by the TLS handshake timeout.
+func (t timeoutDialer) startTLS(c net.Conn, address string) (net.Conn, error) {
+	timeout := t.tls.timeout
+	if timeout == 0 {
+		timeout = t.readTimeout
+	}
+	var span Span
+	if t.tracer != nil {
+		_, span = t.tracer.Start(t.context(), SpanTLS, Attribute{AttrRemoteAddress, address})
+	}
+
+	tc, err := negotiateTLS(t.context(), c, t.tls, timeout)
+	if err != nil {
+		t.logger.log(slog.LevelError, "pqtimeouts: TLS negotiation failed", "address", address, "error", err)
+		if span != nil {
+			span.RecordError(err)
+			span.End()
+		}
+		return nil, err
+	}
+
+	if tc == nil {
+		t.logger.log(slog.LevelWarn, "pqtimeouts: the server refused TLS, continuing without it", "address", address)
+		if span != nil {
+			span.SetAttributes(Attribute{AttrTLS, false})
+			span.End()
+		}
+		return c, nil
+	}
+	state := tc.ConnectionState()
+	t.logger.log(slog.LevelDebug, "pqtimeouts: TLS established", "address", address,
+		"version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+	if span != nil {
+		span.SetAttributes(
+			Attribute{AttrTLS, true},
+			Attribute{AttrTLSVersion, tls.VersionName(state.Version)},
+			Attribute{AttrTLSCipher, tls.CipherSuiteName(state.CipherSuite)})
+		span.End()
+	}
+	return tc, nil
+}
+
+// negotiateTLS upgrades c to TLS. It returns nil without an error if the server refuses TLS and it isn't required.
+func negotiateTLS(ctx context.Context, c net.Conn, settings *tlsSettings, timeout time.Duration) (*tls.Conn, error) {
+	config, err := settings.configFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	timeoutError := func(err error) error {
+		if isTimeout(err) {
+			return &TimeoutError{Phase: PhaseTLSHandshake, Limit: timeout, Err: err}
+		}
+		return err
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request, 8)
+	binary.BigEndian.PutUint32(request[4:], sslRequestCode)
+	if _, err := c.Write(request); err != nil {
+		return nil, timeoutError(err)
+	}
+	reply := make([]byte, 1)
+	if _, err := c.Read(reply); err != nil {
+		return nil, timeoutError(err)
+	}
+
+	switch reply[0] {
+	case 'S':
+	case 'N':
+		if settings.required {
+			return nil, pq.ErrSSLNotSupported
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("pqtimeouts: unexpected reply %q to SSLRequest", reply[0])
+	}
+
+	tc := tls.Client(c, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, timeoutError(err)
+	}
+	return tc, nil
+}
+
+// TLSConnectionState returns the state of the TLS connection when pq-timeouts negotiated TLS itself.
+func (t *timeoutConn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if t.tlsConn == nil {
+		return tls.ConnectionState{}, false
+	}
+	return t.tlsConn.ConnectionState(), true
+}
@@ -0,0 +1,204 @@
+package pqtimeouts
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Kount/pq-timeouts/pqtimeoutstest"
+	"github.com/lib/pq"
+)
+
+// tlsServer answers an SSLRequest on the server end of a pipe with reply, then runs handshake if it is set.
+func tlsServer(server net.Conn, reply byte, handshake func(net.Conn)) {
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(server, request); err != nil {
+		return
+	}
+	server.Write([]byte{reply})
+	if handshake != nil {
+		handshake(server)
+	}
+}
+
+func TestNegotiateTLS(t *testing.T) {
+	cert, pool := pqtimeoutstest.Certificate("db1")
+	client, server := net.Pipe()
+	defer client.Close()
+	go tlsServer(server, 'S', func(c net.Conn) {
+		tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	})
+
+	settings := &tlsSettings{config: &tls.Config{RootCAs: pool, ServerName: "db1"}, required: true}
+	tc, err := negotiateTLS(context.Background(), client, settings, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc == nil || !tc.ConnectionState().HandshakeComplete {
+		t.Error("Expected a completed handshake")
+	}
+}
+
+func TestNegotiateTLSHandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tlsServer(server, 'S', func(c net.Conn) { io.Copy(io.Discard, c) })
+
+	settings := &tlsSettings{config: &tls.Config{InsecureSkipVerify: true}, required: true}
+	_, err := negotiateTLS(context.Background(), client, settings, 20*time.Millisecond)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Phase != PhaseTLSHandshake {
+		t.Errorf("Expected a TLS handshake timeout, got %v", err)
+	}
+}
+
+func TestNegotiateTLSRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go tlsServer(server, 'N', nil)
+
+	settings := &tlsSettings{config: &tls.Config{}, required: true}
+	if _, err := negotiateTLS(context.Background(), client, settings, time.Second); err != pq.ErrSSLNotSupported {
+		t.Errorf("Expected TLS to be required, got %v", err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go tlsServer(server, 'N', nil)
+	settings.required = false
+	if tc, err := negotiateTLS(context.Background(), client, settings, time.Second); tc != nil || err != nil {
+		t.Errorf("Expected to continue without TLS, got %v, %v", tc, err)
+	}
+}
+
+func TestNewTLSSettings(t *testing.T) {
+	settings, connString, err := newTLSSettings(Config{
+		ConnString:          "host=db1 user=pqtest sslmode=verify-full",
+		TLSHandshakeTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connString != "host=db1 user=pqtest sslmode=disable" {
+		t.Errorf("lib/pq should not negotiate TLS, got %q", connString)
+	}
+	if !settings.required || settings.config.ServerName != "db1" || settings.config.InsecureSkipVerify {
+		t.Errorf("TLS settings were not as expected: %+v", settings)
+	}
+
+	settings, connString, _ = newTLSSettings(Config{ConnString: "user=pqtest sslmode=disable", TLSConfig: &tls.Config{}})
+	if settings != nil || connString != "user=pqtest sslmode=disable" {
+		t.Error("sslmode=disable should turn TLS off")
+	}
+
+	if _, _, err := newTLSSettings(Config{ConnString: "user=pqtest sslmode=sometimes", TLSConfig: &tls.Config{}}); err == nil {
+		t.Error("Expected an error for an unsupported sslmode")
+	}
+}
+
+func TestVerifyCAWithoutRootCertificate(t *testing.T) {
+	cert, _ := pqtimeoutstest.Certificate("127.0.0.1")
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.SetStartup(pqtimeoutstest.Startup{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	srv.Handle("SELECT 1", pqtimeoutstest.Response{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	for _, sslmode := range []string{"verify-ca", "require"} {
+		cfg, err := ParseConfig(srv.ConnString() + " tls_handshake_timeout=1000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ConnString = withSetting(cfg.ConnString, "sslmode", sslmode)
+		db := sql.OpenDB(NewConnector(cfg))
+		defer db.Close()
+
+		err = db.Ping()
+		if sslmode == "verify-ca" && err == nil {
+			t.Error("A self-signed server certificate should be rejected by verify-ca against the system roots")
+		}
+		if sslmode == "require" && err != nil {
+			t.Errorf("require should not verify the server certificate without sslrootcert, got %v", err)
+		}
+	}
+}
+
+func TestRequireProviderRootCAs(t *testing.T) {
+	cert, pool := pqtimeoutstest.Certificate("127.0.0.1")
+	_, otherPool := pqtimeoutstest.Certificate("127.0.0.1")
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.SetStartup(pqtimeoutstest.Startup{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+
+	cfg, err := ParseConfig(srv.ConnString() + " tls_handshake_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnString = withSetting(cfg.ConnString, "sslmode", "require")
+	provider := NewMemoryCertificates(Certificates{RootCAs: otherPool})
+	cfg.CertificateProvider = provider
+	db := sql.OpenDB(NewConnector(cfg))
+	defer db.Close()
+
+	if err := db.Ping(); err == nil {
+		t.Error("require should verify the server certificate against the provider's root certificates")
+	}
+	provider.Set(Certificates{RootCAs: pool})
+	if err := db.Ping(); err != nil {
+		t.Errorf("Expected the server certificate to chain to the provider's root certificates, got %v", err)
+	}
+}
+
+func TestWithSetting(t *testing.T) {
+	for _, test := range []struct {
+		connString, expected string
+	}{
+		{"user=pqtest sslmode=require", "user=pqtest sslmode=disable"},
+		{"user=pqtest", "user=pqtest sslmode=disable"},
+		{"user=pqtest password='a sslmode=require b'", "user=pqtest password='a sslmode=require b' sslmode=disable"},
+		{"user=pqtest sslmode = 'require'", "user=pqtest sslmode=disable"},
+	} {
+		if connString := withSetting(test.connString, "sslmode", "disable"); connString != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.connString, connString)
+		}
+	}
+}
+
+func TestConnectorTLS(t *testing.T) {
+	cert, pool := pqtimeoutstest.Certificate("127.0.0.1")
+	srv := pqtimeoutstest.NewServer()
+	defer srv.Close()
+	srv.SetStartup(pqtimeoutstest.Startup{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+
+	cfg, err := ParseConfig(srv.ConnString() + " tls_handshake_timeout=1000 protocol_tracking=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnString = withSetting(cfg.ConnString, "sslmode", "verify-full")
+	cfg.TLSConfig = &tls.Config{RootCAs: pool}
+	db := sql.OpenDB(NewConnector(cfg))
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Raw(func(driverConn any) error {
+		state, ok := driverConn.(interface {
+			TLSConnectionState() (tls.ConnectionState, bool)
+		}).TLSConnectionState()
+		if !ok || state.Version < tls.VersionTLS12 {
+			t.Errorf("Expected a TLS connection, got %v %+v", ok, state)
+		}
+		// The protocol can be followed on an encrypted connection.
+		if s := driverConn.(interface{ State() ConnState }).State(); s != StateIdle {
+			t.Errorf("Expected the connection to be idle, got %v", s)
+		}
+		return nil
+	})
+}
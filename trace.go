@@ -0,0 +1,185 @@
+package pqtimeouts
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Span names used by pq-timeouts.
+const (
+	SpanDial      = "pqtimeouts.dial"
+	SpanTLS       = "pqtimeouts.tls"
+	SpanRoundTrip = "pqtimeouts.roundtrip"
+)
+
+// Attribute keys set on spans.
+const (
+	AttrRemoteAddress    = "net.peer.address"
+	AttrBytesWritten     = "pqtimeouts.bytes_written"
+	AttrBytesRead        = "pqtimeouts.bytes_read"
+	AttrDeadlineExceeded = "pqtimeouts.deadline_exceeded"
+	AttrResponseWait     = "pqtimeouts.response_wait" // Time from the first byte written to the first byte read
+	AttrTLS              = "pqtimeouts.tls"           // Whether the server agreed to TLS
+)
+
+// Attribute is a key and value attached to a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Tracer creates spans for dials, TLS upgrades and request/response round trips. It follows the shape of the
+// OpenTelemetry tracing API so an adapter to it is a few lines, without pq-timeouts depending on it. Implementations
+// must be safe for concurrent use.
+type Tracer interface {
+	// Start creates a span as a child of any span in ctx, returning a context containing the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// tlsApplicationData is the TLS record type of application data. The first such record a client sends marks the end of
+// its handshake.
+const tlsApplicationData = 0x17
+
+type sslPhase int
+
+const (
+	sslNone      sslPhase = iota // No SSLRequest has been sent
+	sslRequested                 // Waiting for the server to accept or refuse TLS
+	sslHandshake                 // The TLS handshake is in progress
+	sslDone                      // The connection is encrypted
+)
+
+// connTrace uses the protocolTracker of a timeoutConn to create spans for its TLS upgrade and for each
+// request/response round trip. Round trips end when the server reports it is ready for the next query. That can't be
+// seen once the connection is encrypted, so on TLS connections a round trip instead ends when the next one starts. It
+// is locked, as lib/pq reads the connection from another goroutine while it writes COPY data.
+type connTrace struct {
+	mu      sync.Mutex
+	tracer  Tracer
+	address string
+	tlsSpan Span
+	ready   int // The number of ReadyForQuery messages the tracker had seen at the last read
+
+	roundTrip        Span
+	roundTripStart   time.Time
+	firstByte        time.Time
+	bytesWritten     int
+	bytesRead        int
+	deadlineExceeded bool
+}
+
+// wrote is called after a write has been passed to the protocolTracker, which saw step.
+func (c *connTrace) wrote(ctx context.Context, step trackedIO, start time.Time, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case step.prev == sslNone && step.ssl == sslRequested:
+		_, c.tlsSpan = c.tracer.Start(ctx, SpanTLS, Attribute{AttrRemoteAddress, c.address})
+		return
+	case step.prev == sslHandshake && step.ssl == sslDone:
+		c.tlsSpan.End()
+	case step.ssl == sslRequested || step.ssl == sslHandshake:
+		return
+	}
+
+	// A write after the response has started to arrive begins a new round trip.
+	if c.roundTrip != nil && c.bytesRead > 0 {
+		c.endRoundTrip()
+	}
+	if c.roundTrip == nil {
+		_, c.roundTrip = c.tracer.Start(ctx, SpanRoundTrip, Attribute{AttrRemoteAddress, c.address})
+		c.roundTripStart = start
+	}
+	c.bytesWritten += n
+	c.ioError(err)
+}
+
+// read is called after a read has been passed to the protocolTracker, which saw step.
+func (c *connTrace) read(step trackedIO, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case step.prev == sslRequested && step.ssl != sslRequested:
+		accepted := step.ssl == sslHandshake
+		c.tlsSpan.SetAttributes(Attribute{AttrTLS, accepted})
+		if !accepted {
+			c.tlsSpan.End()
+		}
+		return
+	case step.ssl == sslRequested || step.ssl == sslHandshake:
+		return
+	}
+
+	if c.roundTrip == nil {
+		return
+	}
+	if c.bytesRead == 0 && n > 0 {
+		c.firstByte = time.Now()
+	}
+	c.bytesRead += n
+	c.ioError(err)
+
+	if step.ready != c.ready {
+		c.ready = step.ready
+		c.endRoundTrip()
+	}
+}
+
+func (c *connTrace) ioError(err error) {
+	if err == nil {
+		return
+	}
+	if isTimeout(err) {
+		c.deadlineExceeded = true
+	}
+	c.roundTrip.RecordError(err)
+}
+
+func (c *connTrace) endRoundTrip() {
+	attrs := []Attribute{
+		{AttrBytesWritten, c.bytesWritten},
+		{AttrBytesRead, c.bytesRead},
+		{AttrDeadlineExceeded, c.deadlineExceeded}}
+	if !c.firstByte.IsZero() {
+		attrs = append(attrs, Attribute{AttrResponseWait, c.firstByte.Sub(c.roundTripStart)})
+	}
+	c.roundTrip.SetAttributes(attrs...)
+	c.roundTrip.End()
+
+	c.roundTrip = nil
+	c.firstByte = time.Time{}
+	c.bytesWritten = 0
+	c.bytesRead = 0
+	c.deadlineExceeded = false
+}
+
+func (c *connTrace) close(ssl sslPhase) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ssl == sslRequested || ssl == sslHandshake {
+		c.tlsSpan.End()
+	}
+	if c.roundTrip != nil {
+		c.endRoundTrip()
+	}
+}
+
+// traceDial runs dial inside a dial span.
+func traceDial(ctx context.Context, tracer Tracer, address string, dial func() (net.Conn, error)) (net.Conn, error) {
+	_, span := tracer.Start(ctx, SpanDial, Attribute{AttrRemoteAddress, address})
+	c, err := dial()
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	return c, err
+}
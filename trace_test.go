@@ -0,0 +1,264 @@
+package pqtimeouts
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]any
+	errs   []error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: make(map[string]any)}
+	span.SetAttributes(attrs...)
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+// sslRequest is the message lib/pq sends to ask the server to upgrade the connection to TLS.
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// testDataConn is a testNetConn that returns scripted data from Read.
+type testDataConn struct {
+	testNetConn
+	reads [][]byte
+}
+
+func (t *testDataConn) Read(b []byte) (int, error) {
+	t.testNetConn.Read(b)
+	if len(t.reads) == 0 {
+		return 0, t.readError
+	}
+	n := copy(b, t.reads[0])
+	t.reads = t.reads[1:]
+	return n, nil
+}
+
+func (t *testDataConn) Write(b []byte) (int, error) {
+	t.testNetConn.Write(b)
+	return len(b), t.writeError
+}
+
+// backendMessage builds a message as sent by the server.
+func backendMessage(typ byte, body string) []byte {
+	n := len(body) + 4
+	return append([]byte{typ, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	tracer := &testTracer{}
+	response := append(backendMessage('C', "SELECT 1\x00"), backendMessage('Z', "I")...)
+	testConn := &testDataConn{reads: [][]byte{{'N'}, response[:3], response[3:]}}
+
+	conn := &timeoutConn{
+		conn:     testConn,
+		protocol: newProtocolTracker(),
+		trace:    &connTrace{tracer: tracer, address: "db1:5432"}}
+
+	conn.Write(sslRequest)
+	conn.Read(make([]byte, 1))
+	conn.Write(backendMessage('Q', "SELECT 1\x00"))
+	conn.Read(make([]byte, 64))
+	conn.Read(make([]byte, 64))
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(tracer.spans))
+	}
+
+	tlsSpan := tracer.spans[0]
+	if tlsSpan.name != SpanTLS || !tlsSpan.ended || tlsSpan.attrs[AttrTLS] != false {
+		t.Errorf("TLS span was not as expected: %+v", tlsSpan)
+	}
+
+	roundTrip := tracer.spans[1]
+	if roundTrip.name != SpanRoundTrip || !roundTrip.ended {
+		t.Errorf("Round trip span was not ended: %+v", roundTrip)
+	}
+
+	if roundTrip.attrs[AttrBytesRead] != len(response) || roundTrip.attrs[AttrBytesWritten] != 14 {
+		t.Errorf("Round trip attributes were not as expected: %+v", roundTrip.attrs)
+	}
+
+	if roundTrip.attrs[AttrDeadlineExceeded] != false {
+		t.Error("Deadline should not have been exceeded")
+	}
+
+	if roundTrip.attrs[AttrRemoteAddress] != "db1:5432" {
+		t.Errorf("Remote address was not as expected: %v", roundTrip.attrs[AttrRemoteAddress])
+	}
+}
+
+func TestTraceTLSUpgrade(t *testing.T) {
+	tracer := &testTracer{}
+	testConn := &testDataConn{reads: [][]byte{{'S'}, {0x16, 3, 3}}}
+
+	conn := &timeoutConn{
+		conn:     testConn,
+		protocol: newProtocolTracker(),
+		trace:    &connTrace{tracer: tracer, address: "db1:5432"}}
+
+	conn.Write(sslRequest)
+	conn.Read(make([]byte, 1))
+	conn.Write([]byte{0x16, 3, 1}) // ClientHello
+	conn.Read(make([]byte, 3))
+
+	if len(tracer.spans) != 1 || tracer.spans[0].ended {
+		t.Fatal("The TLS span should still be open during the handshake")
+	}
+
+	conn.Write([]byte{tlsApplicationData, 3, 3})
+
+	if !tracer.spans[0].ended || tracer.spans[0].attrs[AttrTLS] != true {
+		t.Errorf("TLS span was not as expected: %+v", tracer.spans[0])
+	}
+
+	if len(tracer.spans) != 2 || tracer.spans[1].name != SpanRoundTrip {
+		t.Fatal("Application data should start a round trip")
+	}
+
+	conn.Close()
+
+	if !tracer.spans[1].ended {
+		t.Error("Close should end the round trip")
+	}
+}
+
+func TestTraceDeadlineExceeded(t *testing.T) {
+	tracer := &testTracer{}
+	testConn := &testDataConn{testNetConn: testNetConn{readError: testTimeoutError{}}}
+
+	conn := &timeoutConn{
+		conn:        testConn,
+		readTimeout: time.Second,
+		protocol:    newProtocolTracker(),
+		trace:       &connTrace{tracer: tracer}}
+
+	conn.Write(backendMessage('Q', "SELECT pg_sleep(10)\x00"))
+	conn.Read(make([]byte, 64))
+	conn.Close()
+
+	roundTrip := tracer.spans[0]
+	if roundTrip.attrs[AttrDeadlineExceeded] != true || len(roundTrip.errs) != 1 {
+		t.Errorf("Round trip span was not as expected: %+v", roundTrip)
+	}
+}
+
+func TestTraceCopyIn(t *testing.T) {
+	tracer := &testTracer{}
+	testCopyIn(t, "", func(cfg *Config) { cfg.Tracer = tracer })
+
+	roundTrips := 0
+	for _, span := range tracer.spans {
+		if span.name == SpanRoundTrip && span.ended {
+			roundTrips++
+		}
+	}
+	if roundTrips == 0 {
+		t.Error("Expected the round trips of the COPY to be traced")
+	}
+}
+
+func TestTraceDial(t *testing.T) {
+	tracer := &testTracer{}
+	ctx, parent := tracer.Start(context.Background(), "connect")
+
+	dialer := timeoutDialer{
+		netDial: func(network string, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("Could not connect")
+		},
+		tracer: tracer,
+		ctx:    ctx}
+
+	dialer.Dial("tcp", "db1:5432")
+
+	span := tracer.spans[1]
+	if span.name != SpanDial || span.parent != parent || !span.ended || len(span.errs) != 1 {
+		t.Errorf("Dial span was not as expected: %+v", span)
+	}
+}
+
+type testDriverConn struct {
+	ctx context.Context
+}
+
+func (t *testDriverConn) Prepare(query string) (driver.Stmt, error) { return nil, nil }
+func (t *testDriverConn) Close() error                              { return nil }
+func (t *testDriverConn) Begin() (driver.Tx, error)                 { return nil, nil }
+
+func (t *testDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	t.ctx = ctx
+	return nil, nil
+}
+
+func TestConnectorPropagatesQueryContext(t *testing.T) {
+	tracer := &testTracer{}
+	inner := &testDriverConn{}
+
+	connector := NewConnector(Config{Tracer: tracer})
+	connector.dialOpen = func(d pq.Dialer, name string) (driver.Conn, error) {
+		testConn := &testDataConn{reads: [][]byte{backendMessage('Z', "I")}}
+		conn, err := d.(timeoutDialer).wrap(testConn, nil, "tcp", "db1:5432", time.Now())
+		conn.Write([]byte("startup"))
+		conn.Read(make([]byte, 64))
+		return inner, err
+	}
+
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	wrapped, ok := conn.(*driverConn)
+	if !ok {
+		t.Fatalf("Connection was not wrapped: %T", conn)
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "query")
+	wrapped.QueryContext(ctx, "SELECT 1", nil)
+	wrapped.tc.Write(backendMessage('Q', "SELECT 1\x00"))
+
+	if inner.ctx != ctx {
+		t.Error("The query context was not passed on")
+	}
+
+	last := tracer.spans[len(tracer.spans)-1]
+	if last.name != SpanRoundTrip || last.parent != parent {
+		t.Errorf("Round trip span was not a child of the query span: %+v", last)
+	}
+
+	if _, err := wrapped.ExecContext(ctx, "SELECT 1", nil); err != driver.ErrSkip {
+		t.Errorf("ExecContext should be skipped when not supported: %v", err)
+	}
+}
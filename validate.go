@@ -0,0 +1,307 @@
+package pqtimeouts
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Warning is a risky or conflicting setting found by Validate.
+type Warning struct {
+	Key     string // The setting the warning is about
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Key + ": " + w.Message
+}
+
+// pqTimeoutsSettings are the settings ParseConfig removes from a connection string.
+var pqTimeoutsSettings = map[string]bool{
+	"read_timeout": true, "write_timeout": true, "auth_timeout": true, "query_timeout": true, "copy_timeout": true,
+	"idle_in_transaction_timeout": true, "slow_threshold": true, "slow_query_redact": true,
+	"adaptive_read_timeout": true, "adaptive_percentile": true, "adaptive_multiplier": true,
+	"adaptive_min_read_timeout": true, "adaptive_max_read_timeout": true, "min_throughput": true,
+	"throughput_window": true, "throughput_grace": true, "read_rate_limit": true, "write_rate_limit": true,
+	"pool_read_rate_limit": true, "pool_write_rate_limit": true, "liveness_probe": true,
+	"liveness_probe_timeout": true, "liveness_max": true, "protocol_tracking": true, "log_level": true,
+	"tls_handshake_timeout": true, "server_statement_timeout": true, "server_lock_timeout": true,
+	"server_idle_in_transaction_timeout": true, "server_timeout_margin": true, "sql_hints": true,
+	"buffered": true, "tcp_keepalive": true,
+}
+
+// libpqSettings are the settings lib/pq handles itself or always sends to the server.
+var libpqSettings = map[string]bool{
+	"host": true, "port": true, "dbname": true, "user": true, "password": true, "passfile": true, "service": true,
+	"sslmode": true, "sslcert": true, "sslkey": true, "sslrootcert": true, "sslinline": true, "sslpassword": true,
+	"sslsni": true, "krbsrvname": true, "krbspn": true, "target_session_attrs": true,
+	"fallback_application_name": true, "connect_timeout": true, "disable_prepared_binary_result": true,
+	"binary_parameters": true, "application_name": true, "client_encoding": true, "datestyle": true,
+	"extra_float_digits": true, "options": true,
+}
+
+// serverSettings are common server run-time parameters, which lib/pq passes on in the startup message.
+var serverSettings = map[string]bool{
+	"statement_timeout": true, "lock_timeout": true, "idle_in_transaction_session_timeout": true,
+	"search_path": true, "timezone": true, "role": true, "default_transaction_isolation": true,
+	"default_transaction_read_only": true, "work_mem": true, "intervalstyle": true, "replication": true,
+}
+
+// Validate parses a connection string or URL as ParseConfig does, and returns warnings for settings that conflict
+// with each other or are risky. It returns an error if the connection string can't be parsed.
+func Validate(dsn string) ([]Warning, error) {
+	cfg, err := ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return nil, err
+		}
+	}
+	settings, err := splitSettings(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []Warning
+	warn := func(key, format string, args ...any) {
+		warnings = append(warnings, Warning{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for key := range settings {
+		switch {
+		case strings.HasPrefix(key, "keepalives"):
+			warn(key, "lib/pq does not support libpq's TCP keepalive settings, so it is sent to the server, which "+
+				"will refuse the connection; keepalives are on by default, and tcp_keepalive sets their period")
+		case !pqTimeoutsSettings[key] && !libpqSettings[key] && !serverSettings[strings.ToLower(key)]:
+			warn(key, "unknown setting, which lib/pq sends to the server as a run-time parameter")
+		}
+	}
+
+	if _, ok := settings["connect_timeout"]; !ok {
+		warn("connect_timeout", "not set, so connecting to an unreachable host waits for the operating system "+
+			"to give up, which can take minutes")
+	}
+	if cfg.WriteTimeout > 0 && cfg.TCPKeepAlive < 0 {
+		warn("write_timeout", "set with tcp_keepalive turning keepalives off, so a write to a server that has gone "+
+			"away succeeds as long as it fits in the socket buffer, and only a read finds the connection dead")
+	}
+	if cfg.WriteTimeout > 0 && cfg.ReadTimeout == 0 && cfg.LivenessProbe == "" && cfg.LivenessProber == nil {
+		warn("write_timeout", "set without read_timeout, so a server that disappears while a response is awaited "+
+			"is never timed out")
+	}
+
+	statementTimeout, key := serverStatementTimeout(settings)
+	if statementTimeout > 0 {
+		if cfg.ReadTimeout > 0 && cfg.ReadTimeout < statementTimeout && cfg.LivenessProbe == "" {
+			warn("read_timeout", "%v is lower than %s of %v, so the client gives up on slow statements while "+
+				"the server keeps running them", cfg.ReadTimeout, key, statementTimeout)
+		}
+		if cfg.QueryTimeout > 0 && cfg.QueryTimeout < statementTimeout {
+			warn("query_timeout", "%v is lower than %s of %v, so the client gives up on slow statements while "+
+				"the server keeps running them", cfg.QueryTimeout, key, statementTimeout)
+		}
+	}
+
+	for _, s := range []struct {
+		key string
+		set bool
+	}{{"server_statement_timeout", cfg.ServerStatementTimeout}, {"server_lock_timeout", cfg.ServerLockTimeout}} {
+		if s.set && cfg.QueryTimeout == 0 && cfg.ReadTimeout == 0 {
+			warn(s.key, "set without query_timeout or read_timeout, so it has no effect")
+		}
+	}
+	if cfg.ServerStatementTimeout && (cfg.SQLHints != "" || cfg.LivenessProbe != "" || cfg.LivenessProber != nil) {
+		warn("server_statement_timeout", "set with sql_hints or liveness_probe, which can let a statement run for "+
+			"longer than read_timeout, but the statement_timeout sent when connecting doesn't change, so the server "+
+			"still cancels it")
+	}
+	if cfg.ServerStatementTimeout && statementTimeout > 0 {
+		warn("server_statement_timeout", "%s is already set, so it is kept and none is derived", key)
+	}
+	if cfg.ServerIdleInTransactionTimeout && cfg.IdleInTransactionTimeout == 0 {
+		warn("server_idle_in_transaction_timeout", "set without idle_in_transaction_timeout, so it has no effect")
+	}
+	if cfg.SQLHints != "" && libpqTLS(cfg, settings) {
+		warn("sql_hints", "set while lib/pq negotiates TLS, so statements can't be seen and hints are ignored; "+
+			"set sslmode=disable or tls_handshake_timeout so pq-timeouts negotiates TLS")
+	}
+	if cfg.MinThroughput > 0 && libpqTLS(cfg, settings) {
+		warn("min_throughput", "set while lib/pq negotiates TLS, so responses can't be seen and it has no effect; "+
+			"set sslmode=disable or tls_handshake_timeout so pq-timeouts negotiates TLS")
+	}
+	if cfg.LivenessMax > 0 && cfg.LivenessProbe == "" {
+		warn("liveness_max", "set without liveness_probe, so it has no effect")
+	}
+	if cfg.AdaptiveMinReadTimeout > 0 && cfg.AdaptiveMaxReadTimeout > 0 &&
+		cfg.AdaptiveMinReadTimeout > cfg.AdaptiveMaxReadTimeout {
+		warn("adaptive_min_read_timeout", "%v is higher than adaptive_max_read_timeout of %v",
+			cfg.AdaptiveMinReadTimeout, cfg.AdaptiveMaxReadTimeout)
+	}
+	if cfg.AdaptiveReadTimeout && cfg.ReadTimeout > 0 && cfg.AdaptiveMaxReadTimeout > cfg.ReadTimeout {
+		warn("adaptive_max_read_timeout", "%v is higher than read_timeout of %v, which caps the adaptive read "+
+			"timeout", cfg.AdaptiveMaxReadTimeout, cfg.ReadTimeout)
+	}
+	if !cfg.AdaptiveReadTimeout && (cfg.AdaptiveMinReadTimeout > 0 || cfg.AdaptiveMaxReadTimeout > 0) {
+		warn("adaptive_read_timeout", "not set, so the adaptive read timeout bounds have no effect")
+	}
+
+	// Sort by key so the output is stable.
+	sort.SliceStable(warnings, func(i, j int) bool { return warnings[i].Key < warnings[j].Key })
+	return warnings, nil
+}
+
+// libpqTLS reports whether lib/pq negotiates TLS for cfg, so pq-timeouts only sees encrypted bytes.
+func libpqTLS(cfg Config, settings map[string]string) bool {
+	return cfg.TLSConfig == nil && cfg.TLSHandshakeTimeout == 0 && cfg.CertificateProvider == nil &&
+		settings["sslmode"] != "disable"
+}
+
+// serverStatementTimeout returns the statement_timeout sent to the server, as a setting of its own or in options, and
+// where it was found.
+func serverStatementTimeout(settings map[string]string) (time.Duration, string) {
+	if v, key, ok := serverSetting(settings, "statement_timeout"); ok {
+		if d, ok := parseServerDuration(v); ok {
+			return d, key
+		}
+	}
+	return 0, ""
+}
+
+// serverSetting returns the value of the server run-time parameter name sent to the server, as a setting of its own or
+// in options, and where it was found.
+func serverSetting(settings map[string]string, name string) (value, key string, ok bool) {
+	if v, ok := settings[name]; ok {
+		return v, name, true
+	}
+	options := strings.Fields(settings["options"])
+	for i, option := range options {
+		// Options are given as "-c name=value", "-cname=value" or "--name=value".
+		option = strings.TrimPrefix(strings.TrimPrefix(option, "--"), "-c")
+		if option == "" && i+1 < len(options) {
+			option = options[i+1]
+		}
+		if v, ok := strings.CutPrefix(option, name+"="); ok {
+			return v, "options " + name, true
+		}
+	}
+	return "", "", false
+}
+
+// parseServerDuration parses a server time setting, which is in milliseconds unless it has a unit.
+func parseServerDuration(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{{"ms", time.Millisecond}, {"min", time.Minute}, {"s", time.Second}, {"h", time.Hour}, {"d", 24 * time.Hour}}
+	unit := time.Millisecond
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n * float64(unit)), true
+}
+
+// Setting is a key and value from a lib/pq connection string.
+type Setting struct {
+	Key   string
+	Value string
+}
+
+// String formats the setting for a lib/pq connection string, quoting the value when it needs to be.
+func (s Setting) String() string {
+	if s.Value != "" && !strings.ContainsAny(s.Value, " \t\n\r'\\") {
+		return s.Key + "=" + s.Value
+	}
+	return s.Key + "='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s.Value) + "'"
+}
+
+// missingValueError is returned by ParseSettings for a key with no value.
+type missingValueError struct {
+	key string
+}
+
+func (e *missingValueError) Error() string {
+	return fmt.Sprintf("missing \"=\" after %q in connection string", e.key)
+}
+
+// ParseSettings splits a lib/pq connection string into its settings, in order, as lib/pq does. Values may be single
+// quoted, and backslash escapes are removed.
+func ParseSettings(connString string) ([]Setting, error) {
+	var settings []Setting
+	s := []rune(connString)
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && unicode.IsSpace(s[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpace()
+		if i >= len(s) {
+			return settings, nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !unicode.IsSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+		skipSpace()
+		if i >= len(s) || s[i] != '=' {
+			return nil, &missingValueError{key: key}
+		}
+		i++
+		skipSpace()
+
+		var value []rune
+		if i < len(s) && s[i] == '\'' {
+			i++
+			for ; i < len(s) && s[i] != '\''; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value = append(value, s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted value for %q in connection string", key)
+			}
+			i++
+		} else {
+			for ; i < len(s) && !unicode.IsSpace(s[i]); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value = append(value, s[i])
+			}
+		}
+		settings = append(settings, Setting{key, string(value)})
+	}
+}
+
+// splitSettings returns the settings of a connection string by key, as ParseSettings parses them.
+func splitSettings(dsn string) (map[string]string, error) {
+	list, err := ParseSettings(dsn)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(list))
+	for _, s := range list {
+		settings[s.Key] = s.Value
+	}
+	return settings, nil
+}
@@ -0,0 +1,216 @@
+package pqtimeouts
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// warningKeys returns the keys of warnings.
+func warningKeys(warnings []Warning) []string {
+	var keys []string
+	for _, w := range warnings {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+func hasWarning(warnings []Warning, key string) bool {
+	for _, w := range warnings {
+		if w.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateClean(t *testing.T) {
+	warnings, err := Validate("host=db1 user=pqtest connect_timeout=5 read_timeout=6000 statement_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}
+
+func TestValidateReadTimeoutBelowStatementTimeout(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 read_timeout=500 options='-c statement_timeout=2s'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Key != "read_timeout" {
+		t.Errorf("Expected a read_timeout warning, got %v", warnings)
+	}
+}
+
+func TestValidateMissingConnectTimeout(t *testing.T) {
+	warnings, err := Validate("postgres://pqtest@localhost/pqtest?read_timeout=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasWarning(warnings, "connect_timeout") {
+		t.Errorf("Expected a connect_timeout warning, got %v", warningKeys(warnings))
+	}
+}
+
+func TestValidateWriteTimeoutAlone(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 write_timeout=500 keepalives_idle=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasWarning(warnings, "write_timeout") || !hasWarning(warnings, "keepalives_idle") {
+		t.Errorf("Expected write_timeout and keepalives_idle warnings, got %v", warningKeys(warnings))
+	}
+}
+
+func TestValidateWriteTimeoutKeepalives(t *testing.T) {
+	// Go turns keepalives on by default, so a write_timeout with a read_timeout is fine as it is.
+	for _, dsn := range []string{
+		"user=pqtest connect_timeout=5 read_timeout=1000 write_timeout=500",
+		"user=pqtest connect_timeout=5 read_timeout=1000 write_timeout=500 tcp_keepalive=30000",
+	} {
+		warnings, err := Validate(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != 0 {
+			t.Errorf("Expected no warnings for %q, got %v", dsn, warnings)
+		}
+	}
+
+	warnings, err := Validate("user=pqtest connect_timeout=5 read_timeout=1000 write_timeout=500 tcp_keepalive=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Key != "write_timeout" || !strings.Contains(warnings[0].Message, "tcp_keepalive") {
+		t.Errorf("Expected a write_timeout warning about keepalives being off, got %v", warnings)
+	}
+}
+
+func TestValidateLibpqSettings(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 sslsni=1 krbsrvname=postgres krbspn=postgres/db1 " +
+		"service=app passfile=/etc/pgpass target_session_attrs=read-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings for settings lib/pq handles, got %v", warnings)
+	}
+}
+
+func TestValidateUnknownSetting(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 read_timout=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Key != "read_timout" {
+		t.Errorf("Expected a warning for the misspelled setting, got %v", warnings)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	if _, err := Validate("user=pqtest read_timeout=soon"); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+	if _, err := Validate("user=pqtest password='unterminated"); err == nil {
+		t.Error("Expected an error for an unterminated quote")
+	}
+}
+
+func TestParseServerDuration(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"1500": 1500 * time.Millisecond, "2s": 2 * time.Second, "1min": time.Minute, "250ms": 250 * time.Millisecond} {
+		if d, ok := parseServerDuration(v); !ok || d != want {
+			t.Errorf("Expected %q to be %v, got %v", v, want, d)
+		}
+	}
+}
+
+func TestValidateServerTimeouts(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 statement_timeout=1000 server_statement_timeout=true " +
+		"server_idle_in_transaction_timeout=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 3 || !hasWarning(warnings, "server_statement_timeout") ||
+		!hasWarning(warnings, "server_idle_in_transaction_timeout") {
+		t.Errorf("Expected server timeout warnings, got %v", warningKeys(warnings))
+	}
+}
+
+func TestValidateThroughputOverLibpqTLS(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 min_throughput=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasWarning(warnings, "min_throughput") {
+		t.Errorf("Expected a min_throughput warning, got %v", warningKeys(warnings))
+	}
+
+	for _, dsn := range []string{"sslmode=disable", "sslmode=require tls_handshake_timeout=1000"} {
+		warnings, err := Validate("user=pqtest connect_timeout=5 min_throughput=1000 " + dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasWarning(warnings, "min_throughput") {
+			t.Errorf("Expected no min_throughput warning with %s, got %v", dsn, warnings)
+		}
+	}
+}
+
+func TestValidateHintsOverLibpqTLS(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 sql_hints=keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasWarning(warnings, "sql_hints") {
+		t.Errorf("Expected a sql_hints warning, got %v", warningKeys(warnings))
+	}
+
+	warnings, err = Validate("user=pqtest connect_timeout=5 sql_hints=keep sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings without TLS, got %v", warnings)
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	settings, err := ParseSettings(`host=db1 password='top \'secret\'' options='-c search_path=app'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Setting{{"host", "db1"}, {"password", "top 'secret'"}, {"options", "-c search_path=app"}}
+	if len(settings) != len(want) {
+		t.Fatalf("Settings were not as expected: %q", settings)
+	}
+	for i := range want {
+		if settings[i] != want[i] {
+			t.Errorf("Setting %d was not as expected: %q", i, settings[i])
+		}
+	}
+}
+
+func TestValidateAdaptiveAboveReadTimeout(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 read_timeout=1000 adaptive_read_timeout=true " +
+		"adaptive_max_read_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Key != "adaptive_max_read_timeout" {
+		t.Errorf("Expected an adaptive_max_read_timeout warning, got %v", warnings)
+	}
+}
+
+func TestValidateServerStatementTimeoutWithHints(t *testing.T) {
+	warnings, err := Validate("user=pqtest connect_timeout=5 read_timeout=1000 server_statement_timeout=true " +
+		"sql_hints=keep sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Key != "server_statement_timeout" {
+		t.Errorf("Expected a server_statement_timeout warning, got %v", warnings)
+	}
+}